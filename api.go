@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Maximum size of a JSON request body
+const maxAPIBodySize = 64 << 10
+
+// ItemRequest is the body of POST /api/v1/namespaces/{prefix}/{namespace}/items
+// Name is parsed for an amount unless quantity is given
+type ItemRequest struct {
+	Name     string  `json:"name"`
+	Category string  `json:"category"`
+	Note     string  `json:"note"`
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit"`
+}
+
+// APIHandler serves /api/v1, it is mounted with the prefix stripped:
+//
+//	GET    /namespaces/{prefix}/{namespace}/items
+//	POST   /namespaces/{prefix}/{namespace}/items
+//	GET    /namespaces/{prefix}/{namespace}/items/{uid}
+//	PATCH  /namespaces/{prefix}/{namespace}/items/{uid}
+//	DELETE /namespaces/{prefix}/{namespace}/items/{uid}
+//	POST   /namespaces/{prefix}/{namespace}/items/{uid}/move
+//	GET    /namespaces/{prefix}/{namespace}/items/{uid}/history
+//	GET    /namespaces/{prefix}/{namespace}/history
+//	GET    /namespaces/{prefix}/{namespace}/trash
+//	POST   /namespaces/{prefix}/{namespace}/trash/{uid}/restore
+//	GET    /namespaces/{prefix}/{namespace}/categories
+//	PUT    /namespaces/{prefix}/{namespace}/categories
+//	GET    /namespaces/{prefix}/{namespace}/stores
+//	GET    /namespaces/{prefix}/{namespace}/stores/{name}
+//	PUT    /namespaces/{prefix}/{namespace}/stores/{name}
+//	DELETE /namespaces/{prefix}/{namespace}/stores/{name}
+//
+// Items are listed with ?store={name} to order categories by aisles of a store.
+//
+// Bodies are JSON, If-Match is honoured by PATCH, DELETE and move.
+func (h *Handlers) APIHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || len(parts) > 6 || parts[0] != "namespaces" {
+		writeError(w, r, errRouteNotFound)
+		return
+	}
+	rc := getRequestContext(r)
+	if ok := rc.isAuthorized(); !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	data := namespaceData{NamespacePrefix: parts[1], Namespace: parts[2]}
+	rc, err := data.requestContext(rc.User)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), groceriesRequestContextKey, rc))
+
+	switch {
+	case parts[3] == "categories" && len(parts) == 4:
+		switch r.Method {
+		case http.MethodGet:
+			h.CategoriesHandler(w, r)
+		case http.MethodPut:
+			h.apiSetCategories(w, r, rc)
+		default:
+			writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut)
+		}
+		return
+	case parts[3] == "stores" && len(parts) == 4:
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		h.StoresHandler(w, r)
+		return
+	case parts[3] == "stores" && len(parts) == 5:
+		switch r.Method {
+		case http.MethodGet:
+			h.apiGetStore(w, r, rc, parts[4])
+		case http.MethodPut:
+			h.apiPutStore(w, r, rc, parts[4])
+		case http.MethodDelete:
+			h.apiDeleteStore(w, r, rc, parts[4])
+		default:
+			writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodDelete)
+		}
+		return
+	case parts[3] == "history" && len(parts) == 4:
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		h.HistoryHandler(w, r)
+		return
+	case parts[3] == "trash" && len(parts) == 4:
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		h.TrashHandler(w, r)
+		return
+	case parts[3] == "trash" && len(parts) == 6 && parts[5] == "restore":
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r, http.MethodPost)
+			return
+		}
+		h.apiRestoreItem(w, r, rc, parts[4])
+		return
+	case parts[3] != "items":
+		writeError(w, r, errRouteNotFound)
+		return
+	case len(parts) == 6 && parts[5] == "move":
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r, http.MethodPost)
+			return
+		}
+		h.apiMoveItem(w, r, rc, parts[4])
+		return
+	case len(parts) == 6 && parts[5] == "history":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		h.apiItemHistory(w, r, rc, parts[4])
+		return
+	case len(parts) == 6:
+		writeError(w, r, errRouteNotFound)
+		return
+	case len(parts) == 4:
+		switch r.Method {
+		case http.MethodGet:
+			h.ItemsHandler(w, r)
+		case http.MethodPost:
+			h.apiCreateItem(w, r, rc)
+		default:
+			writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+	uid := parts[4]
+	switch r.Method {
+	case http.MethodGet:
+		h.apiGetItem(w, r, rc, uid)
+	case http.MethodPatch:
+		h.apiPatchItem(w, r, rc, uid)
+	case http.MethodDelete:
+		h.apiDeleteItem(w, r, rc, uid)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+func (h *Handlers) apiCreateItem(w http.ResponseWriter, r *http.Request, rc *RequestContext) {
+	var req ItemRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeError(w, r, bodyError(err))
+		return
+	}
+	item, err := h.addItem(rc, r.Header.Get(wsClientIdHeader), Item{
+		Name:     req.Name,
+		Category: req.Category,
+		Note:     req.Note,
+		Quantity: req.Quantity,
+		Unit:     req.Unit,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", r.URL.Path+"/"+item.UID)
+	w.Header().Set("ETag", itemETag(item))
+	writeJSON(w, http.StatusCreated, item)
+}
+
+func (h *Handlers) apiGetItem(w http.ResponseWriter, r *http.Request, rc *RequestContext, uid string) {
+	item, err := h.store.Get(rc, uid)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeItem(w, item)
+}
+
+func (h *Handlers) apiPatchItem(w http.ResponseWriter, r *http.Request, rc *RequestContext, uid string) {
+	var patch ItemPatch
+	if err := decodeJSONBody(w, r, &patch); err != nil {
+		writeError(w, r, bodyError(err))
+		return
+	}
+	item, err := h.patchItem(rc, r.Header.Get(wsClientIdHeader), uid, patch, func(item Item) error {
+		return checkIfMatch(r, item)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeItem(w, item)
+}
+
+func (h *Handlers) apiDeleteItem(w http.ResponseWriter, r *http.Request, rc *RequestContext, uid string) {
+	_, err := h.deleteItem(rc, r.Header.Get(wsClientIdHeader), uid, func(item Item) error {
+		return checkIfMatch(r, item)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) apiMoveItem(w http.ResponseWriter, r *http.Request, rc *RequestContext, uid string) {
+	var req MoveRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeError(w, r, bodyError(err))
+		return
+	}
+	item, err := h.moveItem(rc, r.Header.Get(wsClientIdHeader), uid, req, func(item Item) error {
+		return checkIfMatch(r, item)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeItem(w, item)
+}
+
+func (h *Handlers) apiSetCategories(w http.ResponseWriter, r *http.Request, rc *RequestContext) {
+	var req CategoryOrder
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeError(w, r, bodyError(err))
+		return
+	}
+	categories, err := h.setCategoryOrder(rc, r.Header.Get(wsClientIdHeader), req.Categories)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CategoryOrder{Categories: categories})
+}
+
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
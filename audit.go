@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AuditEntry is a change of an item, Before is nil for added and restored
+// items, After is nil for deleted ones. Changes of the category order are
+// "categories" entries without an uid and items, only with the orders.
+type AuditEntry struct {
+	Action           string         `json:"action"`
+	UID              string         `json:"uid"`
+	User             string         `json:"user"`
+	At               time.Time      `json:"at"`
+	Before           *Item          `json:"before"`
+	After            *Item          `json:"after"`
+	CategoriesBefore *CategoryOrder `json:"categories_before,omitempty"`
+	CategoriesAfter  *CategoryOrder `json:"categories_after,omitempty"`
+}
+
+// audit records a change of an item which is already stored
+func (h *Handlers) audit(rc *RequestContext, action string, before, after *Item) {
+	entry := AuditEntry{Action: action, Before: before, After: after}
+	if after != nil {
+		entry.UID = after.UID
+	} else {
+		entry.UID = before.UID
+	}
+	h.record(rc, entry)
+}
+
+func (h *Handlers) auditCategories(rc *RequestContext, before, after []string) {
+	h.record(rc, AuditEntry{
+		Action:           "categories",
+		CategoriesBefore: &CategoryOrder{Categories: before},
+		CategoriesAfter:  &CategoryOrder{Categories: after},
+	})
+}
+
+// record stamps entry with the user and time, a failure is only logged
+func (h *Handlers) record(rc *RequestContext, entry AuditEntry) {
+	entry.User, entry.At = rc.User.Username, time.Now().UTC()
+	if err := h.store.Record(rc, entry); err != nil {
+		log.Error().Err(err).Str("namespace", rc.namespaceID()).Str("uid", entry.UID).Msg("Unable to record audit entry")
+	}
+}
+
+// history returns audit entries of a namespace or of a single item if uid is given
+func (h *Handlers) history(rc *RequestContext, uid string) ([]AuditEntry, error) {
+	entries, err := h.store.History(rc)
+	if err != nil || uid == "" {
+		return entries, err
+	}
+	filtered := make([]AuditEntry, 0)
+	for _, entry := range entries {
+		if entry.UID == uid {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered, nil
+}
+
+func (h *Handlers) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	entries, err := h.history(rc, r.URL.Query().Get("uid"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (h *Handlers) apiItemHistory(w http.ResponseWriter, r *http.Request, rc *RequestContext, uid string) {
+	entries, err := h.history(rc, uid)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// checkedStore marks failures of the wrapped store as StoreError,
+// so they are not mistaken for answers like ErrItemNotFound or for bugs
+type checkedStore struct {
+	Store
+}
+
+func storeFailure(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := asAPIError(err); ok {
+		return err
+	}
+	return &StoreError{Op: op, Err: err}
+}
+
+func (s checkedStore) List(rc *RequestContext) ([]Item, error) {
+	items, err := s.Store.List(rc)
+	return items, storeFailure("list", err)
+}
+
+func (s checkedStore) Get(rc *RequestContext, uid string) (Item, error) {
+	item, err := s.Store.Get(rc, uid)
+	return item, storeFailure("get", err)
+}
+
+func (s checkedStore) Create(rc *RequestContext, item Item, event *Message) (Item, error) {
+	item, err := s.Store.Create(rc, item, event)
+	return item, storeFailure("create", err)
+}
+
+func (s checkedStore) Update(rc *RequestContext, uid string, fn func(item *Item) error, event *Message) (Item, error) {
+	item, err := s.Store.Update(rc, uid, fn, event)
+	return item, storeFailure("update", err)
+}
+
+func (s checkedStore) Delete(rc *RequestContext, uid string, check func(item Item) error, event *Message) (Item, error) {
+	item, err := s.Store.Delete(rc, uid, check, event)
+	return item, storeFailure("delete", err)
+}
+
+func (s checkedStore) Trash(rc *RequestContext) ([]Item, error) {
+	items, err := s.Store.Trash(rc)
+	return items, storeFailure("trash", err)
+}
+
+func (s checkedStore) Restore(rc *RequestContext, uid string, event *Message) (Item, error) {
+	item, err := s.Store.Restore(rc, uid, event)
+	return item, storeFailure("restore", err)
+}
+
+func (s checkedStore) Purge(before time.Time) (int, error) {
+	purged, err := s.Store.Purge(before)
+	return purged, storeFailure("purge", err)
+}
+
+func (s checkedStore) Record(rc *RequestContext, entry AuditEntry) error {
+	return storeFailure("record", s.Store.Record(rc, entry))
+}
+
+func (s checkedStore) History(rc *RequestContext) ([]AuditEntry, error) {
+	entries, err := s.Store.History(rc)
+	return entries, storeFailure("history", err)
+}
+
+func (s checkedStore) Since(namespace string, seq int64) ([]json.RawMessage, bool, error) {
+	events, ok, err := s.Store.Since(namespace, seq)
+	return events, ok, storeFailure("since", err)
+}
+
+func (s checkedStore) Seq(namespace string) (int64, error) {
+	seq, err := s.Store.Seq(namespace)
+	return seq, storeFailure("seq", err)
+}
+
+func (s checkedStore) GetMeta(rc *RequestContext, name string) ([]byte, error) {
+	value, err := s.Store.GetMeta(rc, name)
+	return value, storeFailure("get meta", err)
+}
+
+func (s checkedStore) SetMeta(rc *RequestContext, name string, value []byte) error {
+	return storeFailure("set meta", s.Store.SetMeta(rc, name, value))
+}
+
+func (s checkedStore) UpdateMeta(rc *RequestContext, name string, fn func(value []byte) ([]byte, error), event *Message) error {
+	return storeFailure("update meta", s.Store.UpdateMeta(rc, name, fn, event))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// APIError is the body of every failed request.
+// Code is stable and meant for programs, Message is meant for people.
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details maps request fields to what is wrong with them
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+var (
+	errUnauthorized     = &APIError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "missing or unknown token"}
+	errRouteNotFound    = &APIError{Status: http.StatusNotFound, Code: "not_found", Message: "not found"}
+	errMethodNotAllowed = &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "method not allowed"}
+	errInternal         = &APIError{Status: http.StatusInternalServerError, Code: "internal", Message: "internal error"}
+	errUnavailable      = &APIError{Status: http.StatusServiceUnavailable, Code: "storage_unavailable", Message: "storage is unavailable, try again later"}
+)
+
+// Seconds clients are asked to wait before retrying after a storage failure
+const storageRetryAfter = 5
+
+// storeErrors are returned by stores, they can not depend on http
+var storeErrors = map[error]*APIError{
+	ErrItemNotFound:    {Status: http.StatusNotFound, Code: "item_not_found", Message: ErrItemNotFound.Error()},
+	ErrItemExists:      {Status: http.StatusConflict, Code: "item_exists", Message: ErrItemExists.Error()},
+	ErrConflict:        {Status: http.StatusConflict, Code: "conflict", Message: ErrConflict.Error()},
+	ErrVersionMismatch: {Status: http.StatusPreconditionFailed, Code: "version_mismatch", Message: ErrVersionMismatch.Error()},
+}
+
+func fieldError(field, problem string) *APIError {
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    "invalid_field",
+		Message: field + " " + problem,
+		Details: map[string]string{field: problem},
+	}
+}
+
+// bodyError wraps json decoding errors of request bodies
+func bodyError(err error) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: "invalid_body", Message: err.Error()}
+}
+
+// asAPIError returns false for errors unknown to clients, they are internal errors
+func asAPIError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr, true
+	}
+	var storeErr *StoreError
+	if errors.As(err, &storeErr) {
+		return errUnavailable, true
+	}
+	apiErr, ok := storeErrors[err]
+	return apiErr, ok
+}
+
+// writeError writes err as APIError, server side errors are logged and hidden from clients
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr, ok := asAPIError(err)
+	if !ok {
+		apiErr = errInternal
+	}
+	if apiErr.Status >= http.StatusInternalServerError {
+		logger := log.Error().Err(err).Str("method", r.Method).Str("path", r.URL.Path)
+		if rc, ok := r.Context().Value(groceriesRequestContextKey).(*RequestContext); ok {
+			logger = logger.Str("namespace", rc.namespaceID())
+		}
+		logger.Msg("Request failed")
+	}
+	if apiErr == errUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(storageRetryAfter))
+	}
+	writeJSON(w, apiErr.Status, apiErr)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, r, errMethodNotAllowed)
+}
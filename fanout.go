@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Fanout delivers events to hubs of other instances sharing the same store
+type Fanout interface {
+	Publish(msg *Message) error
+}
+
+// RedisFanout publishes events to a redis channel per namespace
+// (events:g:default) and delivers events of other instances to the local hub,
+// viewers of every instance are shared the same way, see presenceState
+type RedisFanout struct {
+	pool *redis.Pool
+	hub  *Hub
+	// origin identifies this instance, its own events are already delivered locally
+	origin string
+}
+
+// fanoutEnvelope carries either an event or a presence state
+type fanoutEnvelope struct {
+	Origin   string         `json:"origin"`
+	Message  *Message       `json:"message,omitempty"`
+	Presence *presenceState `json:"presence,omitempty"`
+}
+
+// newRedisFanout has to be called before the hub is run
+func newRedisFanout(pool *redis.Pool, hub *Hub) *RedisFanout {
+	hub.sharedPresence = make(chan presenceState, sharedPresenceSize)
+	return &RedisFanout{pool: pool, hub: hub, origin: uuid.NewString()}
+}
+
+func (f *RedisFanout) Publish(msg *Message) error {
+	return f.publish(msg.Namespace, fanoutEnvelope{Origin: f.origin, Message: msg})
+}
+
+func (f *RedisFanout) publish(namespace string, envelope fanoutEnvelope) error {
+	conn := f.pool.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("PUBLISH", "events:"+namespace, data)
+	return err
+}
+
+// sharePresence publishes presence states of the local hub
+func (f *RedisFanout) sharePresence() {
+	for state := range f.hub.sharedPresence {
+		state.Origin = f.origin
+		if err := f.publish(state.Namespace, fanoutEnvelope{Origin: f.origin, Presence: &state}); err != nil {
+			log.Error().Err(err).Str("namespace", state.Namespace).Msg("Unable to share presence with other instances")
+		}
+	}
+}
+
+// run keeps the subscription alive, it reconnects if redis goes away
+func (f *RedisFanout) run() {
+	go f.sharePresence()
+	for {
+		if err := f.subscribe(); err != nil {
+			log.Warn().Err(err).Msg("Lost fan-out subscription, reconnecting")
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (f *RedisFanout) subscribe() error {
+	conn := f.pool.Get()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.PSubscribe("events:*"); err != nil {
+		return err
+	}
+	for {
+		// the subscription waits for events as long as it takes,
+		// unlike regular commands bounded by redisTimeout
+		switch v := psc.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			var envelope fanoutEnvelope
+			if err := json.Unmarshal(v.Data, &envelope); err != nil || (envelope.Message == nil && envelope.Presence == nil) {
+				log.Warn().Err(err).Str("channel", v.Channel).Msg("Unable to unmarshal fan-out event")
+				continue
+			}
+			if envelope.Origin == f.origin {
+				continue
+			}
+			if envelope.Presence != nil {
+				envelope.Presence.Origin = envelope.Origin
+				f.hub.remoteStates <- *envelope.Presence
+				continue
+			}
+			f.hub.broadcast <- envelope.Message
+		case error:
+			return v
+		}
+	}
+}
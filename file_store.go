@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FileStore is a MemoryStore which persists every change
+// into an append-only JSON log, one record per line.
+type FileStore struct {
+	*MemoryStore
+	path string
+	file *os.File
+	// live is the number of records written by the last compaction,
+	// records is the number of records in the log since then included
+	live, records int
+}
+
+// The log is compacted once it has compactRatio times more records than
+// the last compaction left, and at least compactMinRecords
+const (
+	compactRatio      = 4
+	compactMinRecords = 10000
+)
+
+type fileRecord struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Field string          `json:"field,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func openFileStore(filePath string) (*FileStore, error) {
+	s := &FileStore{MemoryStore: newMemoryStore(), path: filePath}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	// the log is rewritten on every start and then whenever it grows too much
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	s.journal = s.append
+	return s, nil
+}
+
+func (s *FileStore) Close() error {
+	return s.file.Close()
+}
+
+// append is called with the lock held before the change is applied,
+// so a compaction here writes everything but the change itself
+func (s *FileStore) append(op, key, field string, value []byte) error {
+	if s.records >= compactMinRecords && s.records >= compactRatio*s.live {
+		if err := s.compact(); err != nil {
+			log.Error().Err(err).Str("path", s.path).Msg("Unable to compact the log")
+		}
+	}
+	data, err := json.Marshal(fileRecord{Op: op, Key: key, Field: field, Value: value})
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.records++
+	return s.file.Sync()
+}
+
+func (s *FileStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// most likely a partially written last line after a crash
+			log.Warn().Err(err).Str("path", s.path).Msg("Skipping broken record")
+			continue
+		}
+		// records written before namespace hashes are migrated on the fly,
+		// compaction then rewrites them in the new layout
+		switch record.Op {
+		case "set", "del":
+			namespaceKey, uid, ok := parseLegacyKey(record.Key)
+			if !ok {
+				continue
+			}
+			record.Op = "h" + record.Op
+			record.Key, record.Field = namespaceKey, uid
+		}
+		s.apply(record.Op, record.Key, record.Field, record.Value)
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the log with the current state only and reopens it,
+// the old log is kept if anything fails
+func (s *FileStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	// the new log is written and then appended to through the same file
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	live := 0
+	for key, hash := range s.hashes {
+		for field, value := range hash {
+			data, err := json.Marshal(fileRecord{Op: "hset", Key: key, Field: field, Value: value})
+			if err != nil {
+				tmp.Close()
+				return err
+			}
+			w.Write(append(data, '\n'))
+			live++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = tmp
+	s.live, s.records = live, live
+	return nil
+}
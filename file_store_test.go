@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreCompactsGrowingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &RequestContext{User: &User{Username: "alice"}, NamespacePrefix: "g", Namespace: "default"}
+	for i := 0; i < 20; i++ {
+		if err := s.SetMeta(rc, "order", []byte(`["dairy"]`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := countLines(t, path); lines != 20 {
+		t.Fatalf("log has %d records before compaction, want 20", lines)
+	}
+
+	// pretend the log has grown past the threshold
+	s.records = compactMinRecords
+	if err := s.SetMeta(rc, "order", []byte(`["fruit"]`)); err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(t, path); lines != 2 {
+		t.Fatalf("log has %d records after compaction, want 2", lines)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	value, err := s.GetMeta(rc, "order")
+	if err != nil || string(value) != `["fruit"]` {
+		t.Fatalf("GetMeta after reopening = %s, %v", value, err)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
@@ -3,168 +3,154 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-
-	"github.com/gomodule/redigo/redis"
-	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Handlers struct {
-	pool *redis.Pool
-	hub  *Hub
+	store Store
+	hub   *Hub
+	// fanout is nil when there is only one instance
+	fanout Fanout
+	// namespaceLocks holds a *sync.Mutex per namespace, see lockNamespace
+	namespaceLocks sync.Map
+}
+
+// lockNamespace is held from a change until its event is broadcast,
+// so local clients get events of a namespace in the order of their
+// sequence numbers. The store calls are bounded by its timeouts.
+func (h *Handlers) lockNamespace(rc *RequestContext) func() {
+	mu, _ := h.namespaceLocks.LoadOrStore(rc.namespaceID(), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
 }
 
 type Item struct {
-	UID             string `json:"uid"`
-	Name            string `json:"name"`
-	Category        string `json:"category"`
-	IsChecked       bool   `json:"is_checked"`
+	UID      string `json:"uid"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// Note is free text, e.g. "the lactose-free one"
+	Note      string `json:"note"`
+	IsChecked bool   `json:"is_checked"`
+	// Quantity is zero when it is not known, Unit is empty for plain counts
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit"`
+	// Position orders items of a category, see keyBetween. It is empty
+	// for items which have never been moved, they go after the rest.
+	Position        string `json:"position"`
 	Namespace       string `json:"namespace"`
 	NamespacePrefix string `json:"namespace_prefix"`
+	// Version is incremented on every change, it is also used as ETag
+	Version int64 `json:"version"`
+	// CreatedAt and UpdatedAt are nil for items stored before they existed
+	// and never changed since, see Item.UnmarshalJSON
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	// CreatedBy and CheckedBy are usernames, they are empty for items older than them
+	CreatedBy string `json:"created_by"`
+	CheckedBy string `json:"checked_by"`
+	// CheckedAt is set while the item is checked
+	CheckedAt *time.Time `json:"checked_at"`
+	// DeletedAt is set while the item is in the trash
+	DeletedAt *time.Time `json:"deleted_at"`
 }
 
 func (h *Handlers) ItemsHandler(w http.ResponseWriter, r *http.Request) {
-
-	conn := h.pool.Get()
-	defer conn.Close()
-
 	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
-	keyPattern := rc.buildKeyPattern()
-	log.Print(keyPattern)
-	itemKeys, err := redis.ByteSlices(conn.Do("KEYS", keyPattern))
+	items, err := h.listItems(rc, r.URL.Query().Get("store"))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-	}
-	items := make([]Item, 0)
-	for _, itemKey := range itemKeys {
-		var item Item
-		result, _ := redis.Bytes(conn.Do("GET", itemKey))
-		err = json.Unmarshal(result, &item)
-		if err != nil {
-			continue
-		}
-		items = append(items, item)
+		writeError(w, r, err)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(items)
 }
 
 func (h *Handlers) AddItemHandler(w http.ResponseWriter, r *http.Request) {
-	conn := h.pool.Get()
-	defer conn.Close()
-
 	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
-
-	uid := uuid.NewString()
-
-	name := r.URL.Query().Get("name")
-	if name == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	query := r.URL.Query()
+	item, err := h.addItem(rc, r.Header.Get(wsClientIdHeader), Item{Name: query.Get("name"), Category: query.Get("category"), Note: query.Get("note")})
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-
-	category := r.URL.Query().Get("category")
-
-	item := Item{
-		UID:             uid,
-		Name:            name,
-		Category:        category,
-		IsChecked:       false,
-		Namespace:       rc.Namespace,
-		NamespacePrefix: rc.NamespacePrefix,
-	}
-	data, _ := json.Marshal(item)
-	key := rc.buidlKey(uid)
-	log.Print(key)
-	conn.Do("SET", key, data)
-	w.Write(data)
-
-	msg, _ := json.Marshal(Message{ClientID: r.Header.Get(wsClientIdHeader), Type: "add", Data: item})
-	h.hub.broadcast <- msg
+	writeItem(w, item)
 }
 
 func (h *Handlers) DeleteItemHandler(w http.ResponseWriter, r *http.Request) {
 	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
 	uid := r.URL.Query().Get("uid")
-	if uid == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	conn := h.pool.Get()
-	defer conn.Close()
-	key := rc.buidlKey(uid)
-	log.Print(key)
-	itemRaw, _ := redis.Bytes(conn.Do("GET", key))
-	if len(itemRaw) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	var item Item
-	_ = json.Unmarshal(itemRaw, &item)
-	_, err := conn.Do("DEL", key)
+	_, err := h.deleteItem(rc, r.Header.Get(wsClientIdHeader), uid, func(item Item) error {
+		return checkIfMatch(r, item)
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
-	msg, _ := json.Marshal(Message{ClientID: r.Header.Get(wsClientIdHeader), Type: "delete", Data: item})
-	h.hub.broadcast <- msg
 }
 
 func (h *Handlers) EditItemHandler(w http.ResponseWriter, r *http.Request) {
 	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
-	uid := r.URL.Query().Get("uid")
-	if uid == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	query := r.URL.Query()
+	name, category := query.Get("name"), query.Get("category")
+	patch := ItemPatch{Name: &name, Category: &category}
+	// older clients do not know about notes, they must not erase them
+	if query.Has("note") {
+		note := query.Get("note")
+		patch.Note = &note
 	}
-	name := r.URL.Query().Get("name")
-	category := r.URL.Query().Get("category")
-
-	conn := h.pool.Get()
-	defer conn.Close()
-
-	key := rc.buidlKey(uid)
-	itemRaw, _ := redis.Bytes(conn.Do("GET", key))
-	if len(itemRaw) == 0 {
-		w.WriteHeader(http.StatusNotFound)
+	item, err := h.patchItem(rc, r.Header.Get(wsClientIdHeader), query.Get("uid"), patch, func(item Item) error {
+		return checkIfMatch(r, item)
+	})
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	var item Item
-	_ = json.Unmarshal(itemRaw, &item)
-	item.Name = name
-	item.Category = category
-	updatedItem, _ := json.Marshal(item)
-	conn.Do("SET", key, updatedItem)
-
-	msg, _ := json.Marshal(Message{ClientID: r.Header.Get(wsClientIdHeader), Type: "edit", Data: item})
-	h.hub.broadcast <- msg
-
+	writeItem(w, item)
 }
 
 func (h *Handlers) ToggleItemHandler(w http.ResponseWriter, r *http.Request) {
 	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
 	uid := r.URL.Query().Get("uid")
-	if uid == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	conn := h.pool.Get()
-	defer conn.Close()
-	key := rc.buidlKey(uid)
-	itemRaw, _ := redis.Bytes(conn.Do("GET", key))
-	if len(itemRaw) == 0 {
-		w.WriteHeader(http.StatusNotFound)
+	item, err := h.toggleItem(rc, r.Header.Get(wsClientIdHeader), uid, func(item Item) error {
+		return checkIfMatch(r, item)
+	})
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	var item Item
-	_ = json.Unmarshal(itemRaw, &item)
-	item.IsChecked = !item.IsChecked
-	updatedItem, _ := json.Marshal(item)
-	conn.Do("SET", key, updatedItem)
+	writeItem(w, item)
+}
+
+func (h *Handlers) WSHandler(w http.ResponseWriter, r *http.Request) {
+	serveWS(h, w, r)
+}
+
+func writeItem(w http.ResponseWriter, item Item) {
+	data, _ := json.Marshal(item)
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(updatedItem)
+	w.Header().Set("ETag", itemETag(item))
+	w.Write(data)
+}
 
-	// Notify all connectede clients
-	msg, _ := json.Marshal(Message{ClientID: r.Header.Get(wsClientIdHeader), Type: "toggle", Data: item})
-	h.hub.broadcast <- msg
+func itemETag(item Item) string {
+	return strconv.Quote(strconv.FormatInt(item.Version, 10))
+}
+
+// checkIfMatch compares If-Match header, if any, with the item version
+func checkIfMatch(r *http.Request, item Item) error {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return nil
+	}
+	etag := itemETag(item)
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return nil
+		}
+	}
+	return ErrVersionMismatch
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer serves /items and /ws like main does, over a MemoryStore
+func newTestServer(t *testing.T) *httptest.Server {
+	users = map[string]User{"alice": {Username: "alice"}, "bob": {Username: "bob"}}
+	store := newMemoryStore()
+	hub := newHub(store)
+	go hub.run()
+	h := &Handlers{store: checkedStore{store}, hub: hub}
+	mux := http.NewServeMux()
+	mux.Handle("/items/", http.StripPrefix("/items", ItemsMiddleware(newItemsMux(h))))
+	mux.HandleFunc("/ws", h.WSHandler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type testClient struct {
+	t         *testing.T
+	srv       *httptest.Server
+	token     string
+	namespace string
+	clientID  string
+}
+
+// do calls a legacy /items route and decodes the item it returns, if any
+func (c testClient) do(method, path string, query url.Values, ifMatch string) (int, Item) {
+	c.t.Helper()
+	req, _ := http.NewRequest(method, c.srv.URL+"/items"+path+"?"+query.Encode(), nil)
+	req.Header.Set(authTokenHeader, c.token)
+	req.Header.Set(namespacePrefixHeader, "g")
+	req.Header.Set(namespaceHeader, c.namespace)
+	if c.clientID != "" {
+		req.Header.Set(wsClientIdHeader, c.clientID)
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var item Item
+	json.NewDecoder(resp.Body).Decode(&item)
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("ETag") != "" && resp.Header.Get("ETag") != itemETag(item) {
+		c.t.Errorf("%s %s returned ETag %s for version %d", method, path, resp.Header.Get("ETag"), item.Version)
+	}
+	return resp.StatusCode, item
+}
+
+// testSocket reads events of a websocket subscribed to a namespace
+type testSocket struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	pending [][]byte
+}
+
+func dialTestSocket(t *testing.T, srv *httptest.Server, token, namespace, clientID string) *testSocket {
+	query := url.Values{"token": {token}, "namespace_prefix": {"g"}, "namespace": {namespace}, "client_id": {clientID}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &testSocket{t: t, conn: conn}
+	// the subscription is in place once the join is announced
+	if msg := s.next(); msg.Type != "presence" {
+		t.Fatalf("first event is %q, want presence", msg.Type)
+	}
+	return s
+}
+
+// next returns the next event, several of them may come in a single frame
+func (s *testSocket) next() Message {
+	s.t.Helper()
+	for len(s.pending) == 0 {
+		s.conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.t.Fatalf("no event: %v", err)
+		}
+		s.pending = bytes.Split(data, newline)
+	}
+	var msg Message
+	if err := json.Unmarshal(s.pending[0], &msg); err != nil {
+		s.t.Fatal(err)
+	}
+	s.pending = s.pending[1:]
+	return msg
+}
+
+// expect skips presence events, they depend on who else is connected
+func (s *testSocket) expect(msgType, uid string) Message {
+	s.t.Helper()
+	msg := s.next()
+	for msg.Type == "presence" {
+		msg = s.next()
+	}
+	data, _ := msg.Data.(map[string]interface{})
+	if msg.Type != msgType || data["uid"] != uid {
+		s.t.Fatalf("got %q event of %v, want %q of %s", msg.Type, data["uid"], msgType, uid)
+	}
+	return msg
+}
+
+func TestItemsRoutesOverMemoryStore(t *testing.T) {
+	srv := newTestServer(t)
+	alice := testClient{t: t, srv: srv, token: "alice", namespace: "default"}
+	socket := dialTestSocket(t, srv, "alice", "default", "alice-socket")
+
+	status, item := alice.do(http.MethodGet, "/add", url.Values{"name": {"2 kg apples"}, "category": {"fruit"}}, "")
+	if status != http.StatusOK || item.Name != "apples" || item.Quantity != 2 || item.Unit != "kg" || item.Version != 1 || item.CreatedBy != "alice" {
+		t.Fatalf("add returned %d %+v", status, item)
+	}
+	uid := item.UID
+	socket.expect("add", uid)
+
+	status, item = alice.do(http.MethodGet, "/edit", url.Values{"uid": {uid}, "name": {"pears"}, "category": {"fruit"}}, `"1"`)
+	if status != http.StatusOK || item.Name != "pears" || item.Quantity != 2 || item.Version != 2 {
+		t.Fatalf("edit returned %d %+v", status, item)
+	}
+	socket.expect("edit", uid)
+
+	// a change based on an old version is refused and not announced
+	status, _ = alice.do(http.MethodGet, "/edit", url.Values{"uid": {uid}, "name": {"plums"}, "category": {"fruit"}}, `"1"`)
+	if status != http.StatusPreconditionFailed {
+		t.Fatalf("stale edit returned %d, want %d", status, http.StatusPreconditionFailed)
+	}
+	status, _ = alice.do(http.MethodGet, "/toggle", url.Values{"uid": {uid}}, `"1"`)
+	if status != http.StatusPreconditionFailed {
+		t.Fatalf("stale toggle returned %d, want %d", status, http.StatusPreconditionFailed)
+	}
+
+	status, item = alice.do(http.MethodGet, "/toggle", url.Values{"uid": {uid}}, `W/"2"`)
+	if status != http.StatusOK || !item.IsChecked || item.CheckedBy != "alice" || item.Name != "pears" || item.Version != 3 {
+		t.Fatalf("toggle returned %d %+v", status, item)
+	}
+	socket.expect("toggle", uid)
+
+	status, _ = alice.do(http.MethodGet, "/delete", url.Values{"uid": {uid}}, `"2"`)
+	if status != http.StatusPreconditionFailed {
+		t.Fatalf("stale delete returned %d, want %d", status, http.StatusPreconditionFailed)
+	}
+	status, _ = alice.do(http.MethodGet, "/delete", url.Values{"uid": {uid}}, `"3"`)
+	if status != http.StatusOK {
+		t.Fatalf("delete returned %d", status)
+	}
+	socket.expect("delete", uid)
+
+	status, _ = alice.do(http.MethodGet, "/toggle", url.Values{"uid": {uid}}, "")
+	if status != http.StatusNotFound {
+		t.Fatalf("toggle of a deleted item returned %d, want %d", status, http.StatusNotFound)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/items/", nil)
+	req.Header.Set(authTokenHeader, "alice")
+	req.Header.Set(namespacePrefixHeader, "g")
+	req.Header.Set(namespaceHeader, "default")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []Item
+	json.NewDecoder(resp.Body).Decode(&items)
+	resp.Body.Close()
+	if len(items) != 0 {
+		t.Fatalf("items left after delete: %+v", items)
+	}
+}
+
+func TestHubRoutesEventsByNamespace(t *testing.T) {
+	srv := newTestServer(t)
+	aliceSocket := dialTestSocket(t, srv, "alice", "default", "alice-socket")
+	bobSocket := dialTestSocket(t, srv, "bob", "work", "bob-socket")
+	alice := testClient{t: t, srv: srv, token: "alice", namespace: "default"}
+	bob := testClient{t: t, srv: srv, token: "bob", namespace: "work"}
+
+	// the change made through the socket of alice is not sent back to it
+	_, echoed := testClient{t: t, srv: srv, token: "alice", namespace: "default", clientID: "alice-socket"}.do(http.MethodGet, "/add", url.Values{"name": {"bread"}}, "")
+	_, milk := alice.do(http.MethodGet, "/add", url.Values{"name": {"milk"}}, "")
+	_, nails := bob.do(http.MethodGet, "/add", url.Values{"name": {"nails"}}, "")
+
+	// bob sees the change of his namespace only, not the ones made before it
+	msg := bobSocket.expect("add", nails.UID)
+	if msg.Namespace != "g:work" {
+		t.Errorf("event of %s is sent to g:work", msg.Namespace)
+	}
+	msg = aliceSocket.expect("add", milk.UID)
+	if msg.Namespace != "g:default" || msg.Seq != 2 {
+		t.Errorf("event is %s #%d, want g:default #2", msg.Namespace, msg.Seq)
+	}
+	if echoed.UID == "" {
+		t.Fatal("add with a client id failed")
+	}
+
+	// bob joining the namespace of alice is announced to her
+	dialTestSocket(t, srv, "bob", "default", "")
+	msg = aliceSocket.next()
+	presence, _ := msg.Data.(map[string]interface{})
+	if msg.Type != "presence" || presence["username"] != "bob" || presence["action"] != "join" {
+		t.Errorf("got %q event %v, want join of bob", msg.Type, msg.Data)
+	}
+}
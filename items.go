@@ -0,0 +1,254 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Item operations shared by HTTP handlers and websocket commands.
+// clientID is the origin of a change, it does not receive its own event.
+
+var (
+	errNameRequired = fieldError("name", "is required")
+	errUIDRequired  = fieldError("uid", "is required")
+
+	errNegativeQuantity = fieldError("quantity", "must not be negative")
+)
+
+// isValidationError tells apart errors caused by bad client input
+func isValidationError(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.Code == "invalid_field"
+}
+
+// versionCheck is a precondition which passes when the stored item
+// has the given version, zero version matches anything
+func versionCheck(version int64) func(Item) error {
+	return func(item Item) error {
+		if version != 0 && item.Version != version {
+			return ErrVersionMismatch
+		}
+		return nil
+	}
+}
+
+// addItem stores a new item from its uid, name, category, quantity and unit.
+// uid is generated unless one is given, e.g. by an offline client.
+// Without a quantity the name is parsed for one, see parseQuantity.
+func (h *Handlers) addItem(rc *RequestContext, clientID string, item Item) (Item, error) {
+	// like on patch, a given unit is kept
+	if item.Quantity == 0 {
+		var unit string
+		item.Name, item.Quantity, unit = parseQuantity(item.Name)
+		if item.Unit == "" {
+			item.Unit = unit
+		}
+	}
+	if item.Quantity < 0 {
+		return Item{}, errNegativeQuantity
+	}
+	item.Unit = canonicalUnit(item.Unit)
+	if item.Name == "" {
+		return Item{}, errNameRequired
+	}
+	if item.UID == "" {
+		item.UID = uuid.NewString()
+	}
+	item.IsChecked = false
+	createdAt := time.Now().UTC()
+	item.CreatedAt = &createdAt
+	item.CreatedBy = rc.User.Username
+	item.Namespace = rc.Namespace
+	item.NamespacePrefix = rc.NamespacePrefix
+	unlock := h.lockNamespace(rc)
+	event := newEvent(clientID, "add")
+	item, err := h.store.Create(rc, item, event)
+	if err == nil {
+		h.publish(event)
+	}
+	unlock()
+	if err != nil {
+		return item, err
+	}
+	h.audit(rc, "add", nil, &item)
+	return item, nil
+}
+
+// ItemPatch holds fields to change, nil fields are left as is,
+// an empty patch changes nothing.
+// Without a quantity, or with a zero one, the name is parsed like on add.
+// An amount found in it replaces the stored one, a given unit is kept.
+// Name only edits of older clients leave the stored amount alone,
+// a zero quantity clears it.
+type ItemPatch struct {
+	Name      *string  `json:"name"`
+	Category  *string  `json:"category"`
+	Note      *string  `json:"note"`
+	IsChecked *bool    `json:"is_checked"`
+	Quantity  *float64 `json:"quantity"`
+	Unit      *string  `json:"unit"`
+}
+
+func (h *Handlers) patchItem(rc *RequestContext, clientID, uid string, patch ItemPatch, check func(Item) error) (Item, error) {
+	if uid == "" {
+		return Item{}, errUIDRequired
+	}
+	if patch.Name != nil && (patch.Quantity == nil || *patch.Quantity == 0) {
+		if name, quantity, unit := parseQuantity(*patch.Name); quantity > 0 {
+			patch.Name, patch.Quantity = &name, &quantity
+			if patch.Unit == nil {
+				patch.Unit = &unit
+			}
+		}
+	}
+	// a unit means nothing without a quantity
+	if patch.Quantity != nil && *patch.Quantity == 0 && patch.Unit == nil {
+		unit := ""
+		patch.Unit = &unit
+	}
+	if patch.Name != nil && *patch.Name == "" {
+		return Item{}, errNameRequired
+	}
+	if patch.Quantity != nil && *patch.Quantity < 0 {
+		return Item{}, errNegativeQuantity
+	}
+	// clients apply toggle events to the checked state only
+	var msgType string
+	switch {
+	case patch.Name != nil || patch.Category != nil || patch.Note != nil || patch.Quantity != nil || patch.Unit != nil:
+		msgType = "edit"
+	case patch.IsChecked != nil:
+		msgType = "toggle"
+	default:
+		// nothing to change, the item is returned as it is
+		item, err := h.store.Get(rc, uid)
+		if err == nil {
+			err = check(item)
+		}
+		return item, err
+	}
+	var before Item
+	unlock := h.lockNamespace(rc)
+	event := newEvent(clientID, msgType)
+	item, err := h.store.Update(rc, uid, func(item *Item) error {
+		if err := check(*item); err != nil {
+			return err
+		}
+		before = *item
+		if patch.Name != nil {
+			item.Name = *patch.Name
+		}
+		if patch.Category != nil {
+			item.Category = *patch.Category
+		}
+		if patch.Note != nil {
+			item.Note = *patch.Note
+		}
+		if patch.IsChecked != nil {
+			item.setChecked(*patch.IsChecked, rc.User.Username)
+		}
+		if patch.Quantity != nil {
+			item.Quantity = *patch.Quantity
+		}
+		if patch.Unit != nil {
+			item.Unit = canonicalUnit(*patch.Unit)
+		}
+		return nil
+	}, event)
+	if err == nil {
+		h.publish(event)
+	}
+	unlock()
+	if err != nil {
+		return item, err
+	}
+	h.audit(rc, msgType, &before, &item)
+	return item, nil
+}
+
+func (h *Handlers) editItem(rc *RequestContext, clientID, uid, name, category string, check func(Item) error) (Item, error) {
+	return h.patchItem(rc, clientID, uid, ItemPatch{Name: &name, Category: &category}, check)
+}
+
+func (h *Handlers) toggleItem(rc *RequestContext, clientID, uid string, check func(Item) error) (Item, error) {
+	if uid == "" {
+		return Item{}, errUIDRequired
+	}
+	var before Item
+	unlock := h.lockNamespace(rc)
+	event := newEvent(clientID, "toggle")
+	item, err := h.store.Update(rc, uid, func(item *Item) error {
+		if err := check(*item); err != nil {
+			return err
+		}
+		before = *item
+		item.setChecked(!item.IsChecked, rc.User.Username)
+		return nil
+	}, event)
+	if err == nil {
+		h.publish(event)
+	}
+	unlock()
+	if err != nil {
+		return item, err
+	}
+	h.audit(rc, "toggle", &before, &item)
+	return item, nil
+}
+
+// setChecked records who checked the item and when, unchecking clears it
+func (item *Item) setChecked(isChecked bool, username string) {
+	if item.IsChecked == isChecked {
+		return
+	}
+	item.IsChecked = isChecked
+	item.CheckedBy, item.CheckedAt = "", nil
+	if isChecked {
+		now := time.Now().UTC()
+		item.CheckedBy, item.CheckedAt = username, &now
+	}
+}
+
+// setItemChecked is an idempotent toggle
+func (h *Handlers) setItemChecked(rc *RequestContext, clientID, uid string, isChecked bool, check func(Item) error) (Item, error) {
+	return h.patchItem(rc, clientID, uid, ItemPatch{IsChecked: &isChecked}, check)
+}
+
+func (h *Handlers) deleteItem(rc *RequestContext, clientID, uid string, check func(Item) error) (Item, error) {
+	if uid == "" {
+		return Item{}, errUIDRequired
+	}
+	unlock := h.lockNamespace(rc)
+	event := newEvent(clientID, "delete")
+	item, err := h.store.Delete(rc, uid, check, event)
+	if err == nil {
+		h.publish(event)
+	}
+	unlock()
+	if err != nil {
+		return item, err
+	}
+	h.audit(rc, "delete", &item, nil)
+	return item, nil
+}
+
+// newEvent starts an event of a change, the store fills in the rest
+// when it makes the change, see ItemStore
+func newEvent(clientID, msgType string) *Message {
+	return &Message{ClientID: clientID, Type: msgType}
+}
+
+// publish sends an event already kept in the change log to every client
+// subscribed to its namespace, it is called with the namespace locked
+func (h *Handlers) publish(msg *Message) {
+	h.hub.broadcast <- msg
+	// events of several instances are interleaved on the way anyway,
+	// so the fan-out does not hold back changes made here
+	if h.fanout != nil {
+		if err := h.fanout.Publish(msg); err != nil {
+			log.Error().Err(err).Str("namespace", msg.Namespace).Msg("Unable to publish event to other instances")
+		}
+	}
+}
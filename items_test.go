@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestAddItemParsesName(t *testing.T) {
+	hub := newHub(newMemoryStore())
+	go hub.run()
+	h := &Handlers{store: checkedStore{newMemoryStore()}, hub: hub}
+	rc := &RequestContext{User: &User{Username: "alice"}, NamespacePrefix: "g", Namespace: "default"}
+
+	tests := []struct {
+		item     Item
+		name     string
+		quantity float64
+		unit     string
+		err      error
+	}{
+		{Item{Name: "2 kg apples"}, "apples", 2, "kg", nil},
+		// a given unit is kept, like on patch
+		{Item{Name: "2 apples", Unit: "kg"}, "apples", 2, "kg", nil},
+		{Item{Name: "apples", Unit: "Kilos"}, "apples", 0, "kg", nil},
+		// a given quantity is not parsed from the name
+		{Item{Name: "2 apples", Quantity: 3}, "2 apples", 3, "", nil},
+		{Item{Name: "2 kg"}, "", 0, "", errNameRequired},
+		{Item{Name: "100 g", Unit: "kg"}, "", 0, "", errNameRequired},
+	}
+	for _, tt := range tests {
+		item, err := h.addItem(rc, "", tt.item)
+		if err != tt.err {
+			t.Errorf("addItem(%+v) failed with %v, want %v", tt.item, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if item.Name != tt.name || item.Quantity != tt.quantity || item.Unit != tt.unit {
+			t.Errorf("addItem(%+v) = %q, %v, %q, want %q, %v, %q", tt.item, item.Name, item.Quantity, item.Unit, tt.name, tt.quantity, tt.unit)
+		}
+	}
+}
@@ -28,7 +28,11 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	maxMessageSize = 4096
+
+	// Time allowed for a redis connection, command or reply,
+	// a hung server must not block requests forever.
+	redisTimeout = 5 * time.Second
 
 	// Client ID Header for WebSocket events
 	wsClientIdHeader = "x-ws-client-id"
@@ -53,16 +57,17 @@ type User struct {
 }
 
 var (
-	bind          = flag.String("bind", ":8080", "listen address")
-	kvhost        = flag.String("kvhost", "localhost:6379", "a redis compatible server address")
-	usersFilePath = flag.String("users", "", "a json file with users and keys")
-	env           = flag.String("env", "", "environment to run in (dev is good for frontend)")
+	bind           = flag.String("bind", ":8080", "listen address")
+	kvhost         = flag.String("kvhost", "localhost:6379", "a redis compatible server address")
+	storeSpec      = flag.String("store", "redis", "storage backend: redis, file:/path/to/data.db or memory")
+	usersFilePath  = flag.String("users", "", "a json file with users and keys")
+	env            = flag.String("env", "", "environment to run in (dev is good for frontend)")
+	trashRetention = flag.Duration("trash-retention", 7*24*time.Hour, "how long deleted items can be restored")
 
 	//go:embed static
 	static embed.FS
 
 	newline  = []byte{'\n'}
-	space    = []byte{' '}
 	upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
 
 	users map[string]User
@@ -85,15 +90,25 @@ func main() {
 			log.Fatal().Err(err).Msg("Unable to unmarshal users file")
 		}
 	}
-	pool := newRedisPool(*kvhost)
-	defer pool.Close()
-	hub := newHub()
+	store, err := openStore(*storeSpec)
+	if err != nil {
+		log.Fatal().Err(err).Str("store", *storeSpec).Msg("Unable to open store")
+	}
+	defer store.Close()
+	hub := newHub(store)
+	h := Handlers{store: checkedStore{store}, hub: hub}
+	go purgeTrash(h.store, *trashRetention)
+	// instances sharing redis deliver each other's events to their clients
+	if redisStore, ok := store.(*RedisStore); ok {
+		fanout := newRedisFanout(redisStore.pool, hub)
+		go fanout.run()
+		h.fanout = fanout
+	}
 	go hub.run()
-	h := Handlers{pool: pool, hub: hub}
 
 	fsys, err := fs.Sub(static, "static")
 	if err != nil {
-		log.Fatal().Err(err)
+		log.Fatal().Err(err).Msg("Unable to open static files")
 	}
 	fileServer := http.FileServer(http.FS(fsys))
 
@@ -105,31 +120,28 @@ func main() {
 
 	log.Print(users)
 
-	itemsMux := http.NewServeMux()
-	itemsMux.HandleFunc("/add", h.AddItemHandler)
-	itemsMux.HandleFunc("/delete", h.DeleteItemHandler)
-	itemsMux.HandleFunc("/edit", h.EditItemHandler)
-	itemsMux.HandleFunc("/toggle", h.ToggleItemHandler)
-	itemsMux.HandleFunc("/", h.ItemsHandler)
-
 	mux := http.NewServeMux()
-	mux.Handle("/items/", http.StripPrefix("/items", ItemsMiddleware(itemsMux)))
-	mux.HandleFunc("/ws", func(rw http.ResponseWriter, r *http.Request) {
-		serveWS(hub, rw, r)
-	})
+	// legacy routes, kept for older clients
+	mux.Handle("/items/", http.StripPrefix("/items", ItemsMiddleware(newItemsMux(&h))))
+	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", http.HandlerFunc(h.APIHandler)))
+	mux.HandleFunc("/api/openapi.json", OpenAPIHandler)
+	mux.HandleFunc("/ws", h.WSHandler)
+	mux.HandleFunc("/events", h.EventsHandler)
 	mux.Handle("/", fileServer)
 	err = http.ListenAndServe(*bind, AddLogging(os.Stdout, mux))
-	log.Fatal().Err(err)
+	log.Fatal().Err(err).Msg("Server stopped")
 }
 
 func newRedisPool(kvhost string) *redis.Pool {
 	return &redis.Pool{
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.DialURL(fmt.Sprintf("redis://%s", kvhost))
-			if err != nil {
-				panic(err.Error())
-			}
-			return c, err
+			// a failed dial is returned by pool.Get().Do, it must not take the server down
+			return redis.DialURL(
+				fmt.Sprintf("redis://%s", kvhost),
+				redis.DialConnectTimeout(redisTimeout),
+				redis.DialReadTimeout(redisTimeout),
+				redis.DialWriteTimeout(redisTimeout),
+			)
 		},
 	}
 }
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MemoryStore keeps items in maps mirroring redis namespace hashes,
+// see RequestContext.buildNamespaceKey. Everything is lost on restart.
+type MemoryStore struct {
+	mu     sync.Mutex
+	hashes map[string]map[string][]byte
+	// events are not journaled, only sequences are kept in the seqKey hash,
+	// so after a restart cursors issued before it are told to resync
+	changes map[string]*memoryChangeLog
+	// journal is called with the lock held before a change is applied,
+	// the change is dropped if it returns an error
+	journal func(op, key, field string, value []byte) error
+}
+
+// seqKey is a hash of the last event sequence of every namespace
+const seqKey = "seq"
+
+type memoryChangeLog struct {
+	seq int64
+	// events are ordered by sequence, the last one has seq
+	events []json.RawMessage
+}
+
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		hashes:  map[string]map[string][]byte{},
+		changes: map[string]*memoryChangeLog{},
+	}
+}
+
+func (s *MemoryStore) List(rc *RequestContext) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(rc.buildNamespaceKey())
+}
+
+func (s *MemoryStore) Get(rc *RequestContext, uid string) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var item Item
+	value, ok := s.hashes[rc.buildNamespaceKey()][uid]
+	if !ok {
+		return item, ErrItemNotFound
+	}
+	err := json.Unmarshal(value, &item)
+	return item, err
+}
+
+func (s *MemoryStore) Create(rc *RequestContext, item Item, event *Message) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hashes[rc.buildNamespaceKey()][item.UID]; ok {
+		return item, ErrItemExists
+	}
+	item.bump()
+	if err := s.set(rc, item); err != nil {
+		return item, err
+	}
+	s.logEvent(rc, event, &item)
+	return item, nil
+}
+
+func (s *MemoryStore) Update(rc *RequestContext, uid string, fn func(item *Item) error, event *Message) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var item Item
+	value, ok := s.hashes[rc.buildNamespaceKey()][uid]
+	if !ok {
+		return item, ErrItemNotFound
+	}
+	if err := json.Unmarshal(value, &item); err != nil {
+		return item, err
+	}
+	if err := fn(&item); err != nil {
+		return item, err
+	}
+	item.bump()
+	if err := s.set(rc, item); err != nil {
+		return item, err
+	}
+	s.logEvent(rc, event, &item)
+	return item, nil
+}
+
+func (s *MemoryStore) Delete(rc *RequestContext, uid string, check func(item Item) error, event *Message) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var item Item
+	namespaceKey := rc.buildNamespaceKey()
+	value, ok := s.hashes[namespaceKey][uid]
+	if !ok {
+		return item, ErrItemNotFound
+	}
+	if err := json.Unmarshal(value, &item); err != nil {
+		return item, err
+	}
+	if err := check(item); err != nil {
+		return item, err
+	}
+	data, err := json.Marshal(item.trashed())
+	if err != nil {
+		return item, err
+	}
+	if err := s.apply("hset", rc.buildTrashKey(), uid, data); err != nil {
+		return item, err
+	}
+	if err := s.apply("hdel", namespaceKey, uid, nil); err != nil {
+		return item, err
+	}
+	s.logEvent(rc, event, &item)
+	return item, nil
+}
+
+func (s *MemoryStore) Trash(rc *RequestContext) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.list(rc.buildTrashKey())
+}
+
+func (s *MemoryStore) Restore(rc *RequestContext, uid string, event *Message) (Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var item Item
+	trashKey := rc.buildTrashKey()
+	value, ok := s.hashes[trashKey][uid]
+	if !ok {
+		return item, ErrItemNotFound
+	}
+	if _, ok := s.hashes[rc.buildNamespaceKey()][uid]; ok {
+		return item, ErrItemExists
+	}
+	if err := json.Unmarshal(value, &item); err != nil {
+		return item, err
+	}
+	item.DeletedAt = nil
+	item.bump()
+	if err := s.set(rc, item); err != nil {
+		return item, err
+	}
+	if err := s.apply("hdel", trashKey, uid, nil); err != nil {
+		return item, err
+	}
+	s.logEvent(rc, event, &item)
+	return item, nil
+}
+
+func (s *MemoryStore) Purge(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for key, hash := range s.hashes {
+		if !strings.HasPrefix(key, "trash:") {
+			continue
+		}
+		for uid, value := range hash {
+			var item Item
+			if err := json.Unmarshal(value, &item); err == nil && item.DeletedAt != nil && !item.DeletedAt.Before(before) {
+				continue
+			}
+			if err := s.apply("hdel", key, uid, nil); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *MemoryStore) Since(namespace string, seq int64) ([]json.RawMessage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := s.changeLog(namespace)
+	oldest := changes.seq - int64(len(changes.events)) + 1
+	if seq > changes.seq || seq+1 < oldest {
+		return nil, false, nil
+	}
+	events := changes.events[seq+1-oldest:]
+	return append([]json.RawMessage(nil), events...), true, nil
+}
+
+func (s *MemoryStore) Seq(namespace string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.changeLog(namespace).seq, nil
+}
+
+func (s *MemoryStore) GetMeta(rc *RequestContext, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.hashes[rc.buildMetaKey()][name], nil
+}
+
+func (s *MemoryStore) SetMeta(rc *RequestContext, name string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.apply("hset", rc.buildMetaKey(), name, value)
+}
+
+func (s *MemoryStore) UpdateMeta(rc *RequestContext, name string, fn func(value []byte) ([]byte, error), event *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := fn(s.hashes[rc.buildMetaKey()][name])
+	if err != nil {
+		return err
+	}
+	if err := s.apply("hset", rc.buildMetaKey(), name, value); err != nil {
+		return err
+	}
+	s.logEvent(rc, event, nil)
+	return nil
+}
+
+// Record keeps entries in a hash keyed by time, so they are persisted
+// by FileStore like everything else
+func (s *MemoryStore) Record(rc *RequestContext, entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	historyKey := rc.buildHistoryKey()
+	history := s.hashes[historyKey]
+	at := entry.At.UnixNano()
+	field := historyField(at)
+	for _, ok := history[field]; ok; _, ok = history[field] {
+		at++
+		field = historyField(at)
+	}
+	if err := s.apply("hset", historyKey, field, data); err != nil {
+		return err
+	}
+	if len(history) <= historySize {
+		return nil
+	}
+	oldest := field
+	for field := range history {
+		if field < oldest {
+			oldest = field
+		}
+	}
+	return s.apply("hdel", historyKey, oldest, nil)
+}
+
+func (s *MemoryStore) History(rc *RequestContext) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	historyKey := rc.buildHistoryKey()
+	fields := make([]string, 0, len(s.hashes[historyKey]))
+	for field := range s.hashes[historyKey] {
+		fields = append(fields, field)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(fields)))
+	entries := make([]AuditEntry, 0, len(fields))
+	for _, field := range fields {
+		var entry AuditEntry
+		if err := json.Unmarshal(s.hashes[historyKey][field], &entry); err != nil {
+			log.Warn().Err(err).Str("key", historyKey).Str("field", field).Msg("Unable to unmarshal audit entry")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// historyField orders as a string the same way as the time it is built from
+func historyField(unixNano int64) string {
+	return fmt.Sprintf("%020d", unixNano)
+}
+
+// changeLog must be called with the lock held, a namespace without events
+// since the start continues the sequence kept in the seqKey hash
+func (s *MemoryStore) changeLog(namespace string) *memoryChangeLog {
+	changes, ok := s.changes[namespace]
+	if !ok {
+		changes = &memoryChangeLog{}
+		if value, ok := s.hashes[seqKey][namespace]; ok {
+			changes.seq, _ = strconv.ParseInt(string(value), 10, 64)
+		}
+		s.changes[namespace] = changes
+	}
+	return changes
+}
+
+// logEvent must be called with the lock held right after the change
+// described by event is applied. The change stays even if the sequence
+// cannot be kept, then every cursor of the namespace is told to resync.
+func (s *MemoryStore) logEvent(rc *RequestContext, event *Message, item *Item) {
+	if event == nil {
+		return
+	}
+	changes := s.changeLog(rc.namespaceID())
+	event.stamp(rc, changes.seq+1, item)
+	changes.seq = event.Seq
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = s.apply("hset", seqKey, event.Namespace, []byte(strconv.FormatInt(event.Seq, 10)))
+	}
+	if err != nil {
+		log.Error().Err(err).Str("namespace", event.Namespace).Msg("Unable to keep event, clients will resync")
+		changes.events = nil
+		return
+	}
+	changes.events = append(changes.events, data)
+	if len(changes.events) > changeLogSize {
+		changes.events = changes.events[len(changes.events)-changeLogSize:]
+	}
+}
+
+// list must be called with the lock held
+func (s *MemoryStore) list(key string) ([]Item, error) {
+	items := make([]Item, 0, len(s.hashes[key]))
+	for uid, value := range s.hashes[key] {
+		var item Item
+		if err := json.Unmarshal(value, &item); err != nil {
+			log.Warn().Err(err).Str("key", key).Str("uid", uid).Msg("Unable to unmarshal item")
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// set must be called with the lock held
+func (s *MemoryStore) set(rc *RequestContext, item Item) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return s.apply("hset", rc.buildNamespaceKey(), item.UID, data)
+}
+
+// apply must be called with the lock held
+func (s *MemoryStore) apply(op, key, field string, value []byte) error {
+	if s.journal != nil {
+		if err := s.journal(op, key, field, value); err != nil {
+			return err
+		}
+	}
+	switch op {
+	case "hset":
+		if s.hashes[key] == nil {
+			s.hashes[key] = map[string][]byte{}
+		}
+		s.hashes[key][field] = value
+	case "hdel":
+		delete(s.hashes[key], field)
+		if len(s.hashes[key]) == 0 {
+			delete(s.hashes, key)
+		}
+	}
+	return nil
+}
@@ -31,6 +31,13 @@ func (w *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return h.Hijack()
 }
 
+// Flush is required for event streams
+func (w *StatusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (r *StatusRecorder) WriteHeader(status int) {
 	r.status = status
 	r.ResponseWriter.WriteHeader(status)
@@ -39,6 +46,11 @@ func (r *StatusRecorder) WriteHeader(status int) {
 func (h LoggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	t := time.Now()
 	url := *req.URL
+	// streams can carry the auth token in the query, it must not end up in logs
+	if query := url.Query(); query.Get("token") != "" {
+		query.Set("token", "redacted")
+		url.RawQuery = query.Encode()
+	}
 	recorder := &StatusRecorder{w, w.(http.Hijacker), 200}
 	h.handler.ServeHTTP(recorder, req)
 	if req.MultipartForm != nil {
@@ -56,7 +68,15 @@ func ItemsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		rc := getRequestContext(req)
 		if ok := rc.isAuthorized(); !ok {
-			w.WriteHeader(http.StatusUnauthorized)
+			writeError(w, req, errUnauthorized)
+			return
+		}
+		// headers are checked like websocket commands, a "my:alice" prefix
+		// must not reach personal namespaces of another user
+		data := namespaceData{NamespacePrefix: rc.NamespacePrefix, Namespace: rc.Namespace}
+		rc, err := data.requestContext(rc.User)
+		if err != nil {
+			writeError(w, req, err)
 			return
 		}
 		ctx := req.Context()
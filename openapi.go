@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPIHandler serves an OpenAPI 3 document of the /items routes,
+// schemas are generated from the go types, so they follow any change to them.
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPISpec(itemsRoutes))
+}
+
+type openAPIObject = map[string]interface{}
+
+var headerParams = []struct {
+	ref, name, description string
+	required               bool
+	enum                   []string
+}{
+	{"AuthToken", authTokenHeader, "Token of the user", true, nil},
+	{"NamespacePrefix", namespacePrefixHeader, "g for shared lists, my for personal ones", true, []string{"g", "my"}},
+	{"Namespace", namespaceHeader, "Name of the list", true, nil},
+	{"ClientID", wsClientIdHeader, "Websocket client id, its own changes are not sent back to it", false, nil},
+}
+
+func openAPISpec(routes []Route) openAPIObject {
+	schemas := schemaRegistry{}
+	// events are not returned by any route, they come from /ws and /events
+	schemas.schema(reflect.TypeOf(Message{}))
+	schemas.schema(reflect.TypeOf(Presence{}))
+
+	parameters := openAPIObject{}
+	var headerRefs []interface{}
+	for _, p := range headerParams {
+		schema := openAPIObject{"type": "string"}
+		if p.enum != nil {
+			schema["enum"] = p.enum
+		}
+		parameters[p.ref] = openAPIObject{
+			"name":        p.name,
+			"in":          "header",
+			"description": p.description,
+			"required":    p.required,
+			"schema":      schema,
+		}
+		headerRefs = append(headerRefs, openAPIObject{"$ref": "#/components/parameters/" + p.ref})
+	}
+
+	paths := openAPIObject{}
+	for _, route := range routes {
+		path := "/items" + route.Path
+		item, ok := paths[path].(openAPIObject)
+		if !ok {
+			item = openAPIObject{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = schemas.operation(route, headerRefs)
+	}
+
+	return openAPIObject{
+		"openapi": "3.0.3",
+		"info": openAPIObject{
+			"title":   "Groceries",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": openAPIObject{
+			"schemas":    schemas,
+			"parameters": parameters,
+		},
+	}
+}
+
+func (s schemaRegistry) operation(route Route, headerRefs []interface{}) openAPIObject {
+	parameters := append([]interface{}{}, headerRefs...)
+	for _, q := range route.Query {
+		parameters = append(parameters, openAPIObject{
+			"name":        q.Name,
+			"in":          "query",
+			"description": q.Description,
+			"required":    q.Required,
+			"schema":      s.schema(reflect.TypeOf(q.Example)),
+		})
+	}
+	if route.IfMatch {
+		parameters = append(parameters, openAPIObject{
+			"name":        "If-Match",
+			"in":          "header",
+			"description": "ETag of the item, the change is refused if the item has changed since",
+			"schema":      openAPIObject{"type": "string"},
+		})
+	}
+
+	ok := openAPIObject{"description": "OK"}
+	if route.Response != nil {
+		ok["content"] = openAPIObject{
+			"application/json": openAPIObject{"schema": s.schema(reflect.TypeOf(route.Response))},
+		}
+	}
+	errorResponse := func(description string) openAPIObject {
+		return openAPIObject{
+			"description": description,
+			"content": openAPIObject{
+				"application/json": openAPIObject{"schema": s.schema(reflect.TypeOf(APIError{}))},
+			},
+		}
+	}
+	responses := openAPIObject{
+		"200": ok,
+		"400": errorResponse("Invalid request"),
+		"401": errorResponse("Unknown token"),
+		"500": errorResponse("Internal error"),
+		"503": errorResponse("Storage is unavailable"),
+	}
+	responses["503"].(openAPIObject)["headers"] = openAPIObject{
+		"Retry-After": openAPIObject{
+			"description": "Seconds to wait before retrying",
+			"schema":      openAPIObject{"type": "integer"},
+		},
+	}
+	if route.IfMatch {
+		responses["404"] = errorResponse("Item not found")
+		responses["409"] = errorResponse("Item is being changed concurrently, retry")
+		responses["412"] = errorResponse("Item has changed since If-Match")
+	}
+
+	op := openAPIObject{
+		"summary":    route.Summary,
+		"parameters": parameters,
+		"responses":  responses,
+	}
+	if route.Body != nil {
+		op["requestBody"] = openAPIObject{
+			"required": true,
+			"content": openAPIObject{
+				"application/json": openAPIObject{"schema": s.schema(reflect.TypeOf(route.Body))},
+			},
+		}
+	}
+	return op
+}
+
+// schemaRegistry collects schemas of named structs, they are referenced by name
+type schemaRegistry map[string]interface{}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (s schemaRegistry) schema(t reflect.Type) openAPIObject {
+	if t == nil {
+		return openAPIObject{}
+	}
+	switch t {
+	case timeType:
+		return openAPIObject{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return openAPIObject{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := s.schema(t.Elem())
+		if _, ok := schema["$ref"]; ok {
+			return openAPIObject{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return openAPIObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return openAPIObject{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return openAPIObject{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return openAPIObject{"type": "number"}
+	case reflect.String:
+		return openAPIObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return openAPIObject{"type": "string", "format": "byte"}
+		}
+		return openAPIObject{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return openAPIObject{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			// placeholder stops recursion on self referencing types
+			s[t.Name()] = openAPIObject{}
+			s[t.Name()] = s.structSchema(t)
+		}
+		return openAPIObject{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	// interfaces can hold anything
+	return openAPIObject{}
+}
+
+func (s schemaRegistry) structSchema(t reflect.Type) openAPIObject {
+	properties := openAPIObject{}
+	s.addProperties(t, properties)
+	return openAPIObject{"type": "object", "properties": properties}
+}
+
+// addProperties follows encoding/json rules for tags and embedded structs
+func (s schemaRegistry) addProperties(t reflect.Type, properties openAPIObject) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.addProperties(field.Type, properties)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schema(field.Type)
+	}
+}
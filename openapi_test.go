@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpecCoversItemsRoutes(t *testing.T) {
+	mux := newItemsMux(&Handlers{})
+	paths := openAPISpec(itemsRoutes)["paths"].(openAPIObject)
+
+	// a documented path falling through to a shorter pattern, e.g. "/",
+	// would be answered by the wrong handler
+	for path, item := range paths {
+		itemsPath := strings.TrimPrefix(path, "/items")
+		for method := range item.(openAPIObject) {
+			r := httptest.NewRequest(strings.ToUpper(method), itemsPath, nil)
+			if _, pattern := mux.Handler(r); pattern != itemsPath {
+				t.Errorf("%s %s is served by %q", strings.ToUpper(method), path, pattern)
+			}
+		}
+	}
+
+	for _, route := range itemsRoutes {
+		item, ok := paths["/items"+route.Path].(openAPIObject)
+		if !ok {
+			t.Errorf("%s is missing from the spec", route.Path)
+			continue
+		}
+		if _, ok := item[strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s is missing from the spec", route.Method, route.Path)
+		}
+	}
+}
+
+func TestRegisterRoutesEnforcesMethod(t *testing.T) {
+	mux := newItemsMux(&Handlers{})
+
+	for _, route := range itemsRoutes {
+		method := http.MethodPost
+		if route.Method == http.MethodPost {
+			method = http.MethodGet
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, route.Path, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s returned %d, want %d", method, route.Path, w.Code, http.StatusMethodNotAllowed)
+		}
+		if allow := w.Header().Get("Allow"); allow != route.Method {
+			t.Errorf("%s %s allows %q, want %q", method, route.Path, allow, route.Method)
+		}
+	}
+}
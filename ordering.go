@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Name of the category order document, see MetaStore
+const categoryOrderMeta = "category_order"
+
+// positionDigits are ordered the same way as their bytes,
+// so positions can be compared as plain strings
+const positionDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// CategoryOrder is the data of category "reorder" events and the body of category order requests
+type CategoryOrder struct {
+	Categories []string `json:"categories"`
+}
+
+// MoveRequest puts an item right before or right after another one,
+// the item is moved to the category of that one
+type MoveRequest struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+var errMoveTarget = &APIError{
+	Status:  http.StatusBadRequest,
+	Code:    "invalid_field",
+	Message: "exactly one of before and after is required and it must be another item",
+	Details: map[string]string{"before": "or after is required", "after": "or before is required"},
+}
+
+// keyBetween returns a position between a and b, an empty a is the start
+// and an empty b is the end of a list. a must be less than b, positions
+// never end with the zero digit, so there is always room between two of them.
+func keyBetween(a, b string) string {
+	if b != "" {
+		n := 0
+		for n < len(b) && positionDigit(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			if n > len(a) {
+				return b[:n] + keyBetween("", b[n:])
+			}
+			return b[:n] + keyBetween(a[n:], b[n:])
+		}
+	}
+	digitA := 0
+	if a != "" {
+		digitA = strings.IndexByte(positionDigits, a[0])
+	}
+	digitB := len(positionDigits)
+	if b != "" {
+		digitB = strings.IndexByte(positionDigits, b[0])
+	}
+	if digitB-digitA > 1 {
+		return string(positionDigits[(digitA+digitB+1)/2])
+	}
+	if b != "" && len(b) > 1 {
+		return b[:1]
+	}
+	if a == "" {
+		return string(positionDigits[digitA]) + keyBetween("", "")
+	}
+	return string(positionDigits[digitA]) + keyBetween(a[1:], "")
+}
+
+func positionDigit(position string, i int) byte {
+	if i < len(position) {
+		return position[i]
+	}
+	return positionDigits[0]
+}
+
+// sortItems orders items by category order, categories missing from it
+// go after the rest by name, and by position within a category
+func sortItems(items []Item, categories []string) {
+	rank := make(map[string]int, len(categories))
+	for i, category := range categories {
+		rank[category] = i
+	}
+	categoryRank := func(category string) int {
+		if i, ok := rank[category]; ok {
+			return i
+		}
+		return len(categories)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if ra, rb := categoryRank(a.Category), categoryRank(b.Category); ra != rb {
+			return ra < rb
+		}
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		if a.Position != b.Position {
+			if a.Position == "" || b.Position == "" {
+				return b.Position == ""
+			}
+			return a.Position < b.Position
+		}
+		// items of unknown age are the oldest ones
+		if a.CreatedAt == nil || b.CreatedAt == nil {
+			if (a.CreatedAt == nil) != (b.CreatedAt == nil) {
+				return a.CreatedAt == nil
+			}
+		} else if !a.CreatedAt.Equal(*b.CreatedAt) {
+			return a.CreatedAt.Before(*b.CreatedAt)
+		}
+		return a.UID < b.UID
+	})
+}
+
+func (h *Handlers) categoryOrder(rc *RequestContext) ([]string, error) {
+	value, err := h.store.GetMeta(rc, categoryOrderMeta)
+	if err != nil || value == nil {
+		return []string{}, err
+	}
+	var order CategoryOrder
+	if err := json.Unmarshal(value, &order); err != nil {
+		return nil, err
+	}
+	return order.Categories, nil
+}
+
+func (h *Handlers) setCategoryOrder(rc *RequestContext, clientID string, categories []string) ([]string, error) {
+	if categories == nil {
+		categories = []string{}
+	}
+	order := CategoryOrder{Categories: categories}
+	before := CategoryOrder{Categories: []string{}}
+	unlock := h.lockNamespace(rc)
+	event := newEvent(clientID, "reorder")
+	event.Data = order
+	err := h.store.UpdateMeta(rc, categoryOrderMeta, func(value []byte) ([]byte, error) {
+		if value != nil {
+			if err := json.Unmarshal(value, &before); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(order)
+	}, event)
+	if err == nil {
+		h.publish(event)
+	}
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	h.auditCategories(rc, before.Categories, categories)
+	return categories, nil
+}
+
+// listItems returns items of a namespace in the order they are shown,
+// categories follow aisles of the store profile if one is given
+func (h *Handlers) listItems(rc *RequestContext, storeName string) ([]Item, error) {
+	var categories []string
+	if storeName != "" {
+		profile, err := h.storeProfile(rc, storeName)
+		if err != nil {
+			return nil, err
+		}
+		categories = profile.categories()
+	} else {
+		var err error
+		if categories, err = h.categoryOrder(rc); err != nil {
+			return nil, err
+		}
+	}
+	items, err := h.store.List(rc)
+	if err != nil {
+		return nil, err
+	}
+	sortItems(items, categories)
+	return items, nil
+}
+
+// moveItem places an item right before or after another item of any category.
+// Items of that category without a position, or with the same one after
+// concurrent moves, get new positions first. Every changed item is sent as
+// a "reorder" event.
+func (h *Handlers) moveItem(rc *RequestContext, clientID, uid string, req MoveRequest, check func(Item) error) (Item, error) {
+	if uid == "" {
+		return Item{}, errUIDRequired
+	}
+	targetUID := req.Before + req.After
+	if (req.Before == "") == (req.After == "") || targetUID == uid {
+		return Item{}, errMoveTarget
+	}
+	// siblings are renumbered with the namespace locked, see setPosition
+	unlock := h.lockNamespace(rc)
+	defer unlock()
+	items, err := h.store.List(rc)
+	if err != nil {
+		return Item{}, err
+	}
+	sortItems(items, nil)
+	var target, moved *Item
+	for i := range items {
+		if items[i].UID == targetUID {
+			target = &items[i]
+		}
+		if items[i].UID == uid {
+			moved = &items[i]
+		}
+	}
+	if moved == nil {
+		return Item{}, ErrItemNotFound
+	}
+	if target == nil {
+		return Item{}, errMoveTarget
+	}
+	// siblings must not be renumbered for a move which is refused,
+	// the item is checked again when it is moved
+	if err := check(*moved); err != nil {
+		return Item{}, err
+	}
+	category := target.Category
+	var siblings []Item
+	for _, item := range items {
+		if item.Category == category && item.UID != uid {
+			siblings = append(siblings, item)
+		}
+	}
+
+	// positions of siblings have to be strictly increasing
+	positions := make([]string, len(siblings))
+	prev := ""
+	for i, sibling := range siblings {
+		position := sibling.Position
+		if position == "" || position <= prev {
+			position = keyBetween(prev, "")
+			if err := h.setPosition(rc, sibling.UID, position); err != nil {
+				return Item{}, err
+			}
+		}
+		positions[i], prev = position, position
+	}
+
+	lower, upper := "", ""
+	for i, sibling := range siblings {
+		if sibling.UID != targetUID {
+			continue
+		}
+		if req.Before != "" {
+			upper = positions[i]
+			if i > 0 {
+				lower = positions[i-1]
+			}
+		} else {
+			lower = positions[i]
+			if i+1 < len(positions) {
+				upper = positions[i+1]
+			}
+		}
+	}
+	var before Item
+	event := newEvent(clientID, "reorder")
+	item, err := h.store.Update(rc, uid, func(item *Item) error {
+		if err := check(*item); err != nil {
+			return err
+		}
+		before = *item
+		item.Category = category
+		item.Position = keyBetween(lower, upper)
+		return nil
+	}, event)
+	if err != nil {
+		return item, err
+	}
+	h.publish(event)
+	h.audit(rc, "move", &before, &item)
+	return item, nil
+}
+
+// setPosition notifies every client, the one moving an item also has to learn about it.
+// It must be called with the namespace locked.
+func (h *Handlers) setPosition(rc *RequestContext, uid, position string) error {
+	event := newEvent("", "reorder")
+	_, err := h.store.Update(rc, uid, func(item *Item) error {
+		item.Position = position
+		return nil
+	}, event)
+	if err == ErrItemNotFound {
+		// deleted in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h.publish(event)
+	return nil
+}
+
+func (h *Handlers) MoveItemHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	query := r.URL.Query()
+	req := MoveRequest{Before: query.Get("before"), After: query.Get("after")}
+	item, err := h.moveItem(rc, r.Header.Get(wsClientIdHeader), query.Get("uid"), req, func(item Item) error {
+		return checkIfMatch(r, item)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeItem(w, item)
+}
+
+func (h *Handlers) CategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	categories, err := h.categoryOrder(rc)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, CategoryOrder{Categories: categories})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestKeyBetween(t *testing.T) {
+	insert := func(keys []string, i int) []string {
+		a, b := "", ""
+		if i > 0 {
+			a = keys[i-1]
+		}
+		if i < len(keys) {
+			b = keys[i]
+		}
+		key := keyBetween(a, b)
+		if key <= a || (b != "" && key >= b) {
+			t.Fatalf("keyBetween(%q, %q) = %q, it is not between them", a, b, key)
+		}
+		if strings.HasSuffix(key, "0") {
+			t.Fatalf("keyBetween(%q, %q) = %q, it ends with zero", a, b, key)
+		}
+		return append(keys[:i], append([]string{key}, keys[i:]...)...)
+	}
+
+	var front, back, random []string
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 1000; n++ {
+		front = insert(front, 0)
+		back = insert(back, len(back))
+		random = insert(random, r.Intn(len(random)+1))
+	}
+	// repeated inserts at the same point grow keys slowly
+	for _, keys := range [][]string{front, back} {
+		for _, key := range keys {
+			if len(key) > 200 {
+				t.Fatalf("key %q is too long", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Presence is the data of "presence" events, it is sent when a user opens
+// a namespace for the first time or closes the last connection to it.
+// Instances sharing redis see viewers of each other, see presenceState.
+type Presence struct {
+	Username string `json:"username"`
+	// Action is either join or leave
+	Action string `json:"action"`
+	// Viewers are all users looking at the namespace after the change
+	Viewers []string `json:"viewers"`
+}
+
+type PresenceResponse struct {
+	Namespace string   `json:"namespace"`
+	Viewers   []string `json:"viewers"`
+}
+
+type presenceRequest struct {
+	namespace string
+	viewers   chan []string
+}
+
+// presenceState is the set of users connected to an instance in a namespace.
+// Instances share it on every change and every presenceInterval, a state
+// not refreshed within presenceTTL belongs to an instance which is gone.
+type presenceState struct {
+	Origin    string   `json:"origin"`
+	Namespace string   `json:"namespace"`
+	Viewers   []string `json:"viewers"`
+}
+
+type remotePresence struct {
+	viewers []string
+	seen    time.Time
+}
+
+const (
+	presenceInterval = 10 * time.Second
+	presenceTTL      = 3 * presenceInterval
+	// sharedPresenceSize is the number of states waiting to be shared,
+	// more are dropped and shared with the next refresh
+	sharedPresenceSize = 256
+)
+
+// join must be called from the hub loop
+func (h *Hub) join(client *Client, namespace string) {
+	if client.namespaces[namespace] {
+		return
+	}
+	client.namespaces[namespace] = true
+	viewers, ok := h.presence[namespace]
+	if !ok {
+		viewers = map[string]int{}
+		h.presence[namespace] = viewers
+	}
+	viewers[client.user.Username]++
+	if viewers[client.user.Username] > 1 {
+		return
+	}
+	h.sharePresence(namespace)
+	// the user is already looking at it through another instance
+	if h.isRemoteViewer(namespace, client.user.Username) {
+		return
+	}
+	h.deliver(h.presenceMessage(namespace, client.user.Username, "join"))
+}
+
+// leave must be called from the hub loop
+func (h *Hub) leave(client *Client, namespace string) {
+	if !client.namespaces[namespace] {
+		return
+	}
+	delete(client.namespaces, namespace)
+	delete(client.held, namespace)
+	viewers := h.presence[namespace]
+	viewers[client.user.Username]--
+	if viewers[client.user.Username] > 0 {
+		return
+	}
+	delete(viewers, client.user.Username)
+	if len(viewers) == 0 {
+		delete(h.presence, namespace)
+	}
+	h.sharePresence(namespace)
+	if h.isRemoteViewer(namespace, client.user.Username) {
+		return
+	}
+	h.deliver(h.presenceMessage(namespace, client.user.Username, "leave"))
+}
+
+// updateRemotePresence must be called from the hub loop, it keeps the state
+// of another instance and tells local clients about users joining or leaving
+// the namespace with it
+func (h *Hub) updateRemotePresence(state presenceState) {
+	if _, ok := h.origins[state.Origin]; !ok {
+		// a new instance does not know about viewers of this one yet
+		h.shareAllPresence()
+	}
+	h.origins[state.Origin] = time.Now()
+	before := h.viewers(state.Namespace)
+	states := h.remotePresence[state.Namespace]
+	if states == nil {
+		states = map[string]remotePresence{}
+		h.remotePresence[state.Namespace] = states
+	}
+	states[state.Origin] = remotePresence{viewers: state.Viewers, seen: time.Now()}
+	if len(state.Viewers) == 0 {
+		delete(states, state.Origin)
+	}
+	if len(states) == 0 {
+		delete(h.remotePresence, state.Namespace)
+	}
+	h.announceViewers(state.Namespace, before)
+}
+
+// refreshPresence must be called from the hub loop every presenceInterval
+func (h *Hub) refreshPresence() {
+	h.shareAllPresence()
+	expired := time.Now().Add(-presenceTTL)
+	for origin, seen := range h.origins {
+		if seen.Before(expired) {
+			delete(h.origins, origin)
+		}
+	}
+	for namespace, states := range h.remotePresence {
+		before := h.viewers(namespace)
+		for origin, state := range states {
+			if state.seen.Before(expired) {
+				delete(states, origin)
+			}
+		}
+		if len(states) == 0 {
+			delete(h.remotePresence, namespace)
+		}
+		h.announceViewers(namespace, before)
+	}
+}
+
+// announceViewers sends join and leave events for the difference between
+// the viewers of a namespace before a change and now
+func (h *Hub) announceViewers(namespace string, before []string) {
+	after := h.viewers(namespace)
+	for _, username := range after {
+		if !containsString(before, username) {
+			h.deliver(h.presenceMessage(namespace, username, "join"))
+		}
+	}
+	for _, username := range before {
+		if !containsString(after, username) {
+			h.deliver(h.presenceMessage(namespace, username, "leave"))
+		}
+	}
+}
+
+func (h *Hub) isRemoteViewer(namespace, username string) bool {
+	for _, state := range h.remotePresence[namespace] {
+		if containsString(state.viewers, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharePresence passes local viewers of a namespace to other instances,
+// it never waits for them
+func (h *Hub) sharePresence(namespace string) {
+	if h.sharedPresence == nil {
+		return
+	}
+	viewers := make([]string, 0, len(h.presence[namespace]))
+	for username := range h.presence[namespace] {
+		viewers = append(viewers, username)
+	}
+	sort.Strings(viewers)
+	select {
+	case h.sharedPresence <- presenceState{Namespace: namespace, Viewers: viewers}:
+	default:
+		log.Warn().Str("namespace", namespace).Msg("Unable to share presence, it is shared with the next refresh")
+	}
+}
+
+func (h *Hub) shareAllPresence() {
+	for namespace := range h.presence {
+		h.sharePresence(namespace)
+	}
+}
+
+// viewers are local and remote users looking at the namespace
+func (h *Hub) viewers(namespace string) []string {
+	viewers := make([]string, 0, len(h.presence[namespace]))
+	for username := range h.presence[namespace] {
+		viewers = append(viewers, username)
+	}
+	for _, state := range h.remotePresence[namespace] {
+		for _, username := range state.viewers {
+			if !containsString(viewers, username) {
+				viewers = append(viewers, username)
+			}
+		}
+	}
+	sort.Strings(viewers)
+	return viewers
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hub) presenceMessage(namespace, username, action string) *Message {
+	return &Message{
+		Type:      "presence",
+		Namespace: namespace,
+		Data:      Presence{Username: username, Action: action, Viewers: h.viewers(namespace)},
+	}
+}
+
+func (h *Handlers) PresenceHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	req := presenceRequest{namespace: rc.namespaceID(), viewers: make(chan []string, 1)}
+	h.hub.presenceRequests <- req
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PresenceResponse{Namespace: req.namespace, Viewers: <-req.viewers})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPresenceIsMergedAcrossInstances(t *testing.T) {
+	hub := newHub(newMemoryStore())
+	hub.sharedPresence = make(chan presenceState, sharedPresenceSize)
+	client := &Client{send: make(chan []byte, 16), user: &User{Username: "alice"}, namespaces: map[string]bool{}}
+	hub.clients[client] = true
+
+	events := func() []Presence {
+		var presences []Presence
+		for len(client.send) > 0 {
+			var msg struct{ Data Presence }
+			json.Unmarshal(<-client.send, &msg)
+			presences = append(presences, msg.Data)
+		}
+		return presences
+	}
+	shared := func() [][]string {
+		var states [][]string
+		for len(hub.sharedPresence) > 0 {
+			states = append(states, (<-hub.sharedPresence).Viewers)
+		}
+		return states
+	}
+	expect := func(step string, got, want interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", step, got, want)
+		}
+	}
+
+	hub.join(client, "g:default")
+	expect("local join", events(), []Presence{{Username: "alice", Action: "join", Viewers: []string{"alice"}}})
+	expect("local join shared", shared(), [][]string{{"alice"}})
+
+	// a new instance gets the local state right away
+	hub.updateRemotePresence(presenceState{Origin: "b", Namespace: "g:default", Viewers: []string{"alice", "bob"}})
+	expect("remote join", events(), []Presence{{Username: "bob", Action: "join", Viewers: []string{"alice", "bob"}}})
+	expect("remote join shared", shared(), [][]string{{"alice"}})
+
+	// alice is still there through the other instance
+	hub.leave(client, "g:default")
+	expect("local leave", events(), []Presence(nil))
+	expect("local leave shared", shared(), [][]string{{}})
+	expect("viewers", hub.viewers("g:default"), []string{"alice", "bob"})
+
+	// states which are not refreshed are dropped
+	hub.join(client, "g:default")
+	shared()
+	state := hub.remotePresence["g:default"]["b"]
+	state.seen = time.Now().Add(-presenceTTL - time.Second)
+	hub.remotePresence["g:default"]["b"] = state
+	hub.refreshPresence()
+	expect("expired", events(), []Presence{{Username: "bob", Action: "leave", Viewers: []string{"alice"}}})
+	expect("refresh shared", shared(), [][]string{{"alice"}})
+}
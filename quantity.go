@@ -0,0 +1,90 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// units maps spellings of common units to their normalised form
+var units = map[string]string{
+	"g": "g", "gr": "g", "gram": "g", "grams": "g", "г": "g", "гр": "g", "грамм": "g",
+	"kg": "kg", "kilo": "kg", "kilos": "kg", "кг": "kg", "кило": "kg",
+	"mg": "mg", "мг": "mg",
+	"l": "l", "liter": "l", "liters": "l", "litre": "l", "litres": "l", "л": "l", "литр": "l", "литра": "l", "литров": "l",
+	"ml": "ml", "мл": "ml",
+	"pc": "pcs", "pcs": "pcs", "piece": "pcs", "pieces": "pcs", "шт": "pcs", "штук": "pcs", "штуки": "pcs",
+	"pack": "pack", "packs": "pack", "pkg": "pack", "уп": "pack", "упак": "pack", "пачка": "pack", "пачки": "pack",
+	"can": "can", "cans": "can", "банка": "can", "банки": "can",
+	"bottle": "bottle", "bottles": "bottle", "бут": "bottle", "бутылка": "bottle", "бутылки": "bottle",
+}
+
+// amountPattern matches "2", "1,5", "2kg", "1л", "x12" and "12x"
+var amountPattern = regexp.MustCompile(`^[xх×]?(\d+(?:[.,]\d+)?)(\p{L}*)\.?$`)
+
+// normaliseUnit returns false for unknown units
+func normaliseUnit(unit string) (string, bool) {
+	unit = strings.TrimSuffix(strings.ToLower(unit), ".")
+	normalised, ok := units[unit]
+	return normalised, ok
+}
+
+// canonicalUnit normalises known units and keeps the rest as they are
+func canonicalUnit(unit string) string {
+	if normalised, ok := normaliseUnit(unit); ok {
+		return normalised
+	}
+	return strings.TrimSpace(unit)
+}
+
+// parseAmount parses a single word holding a quantity and maybe a unit
+func parseAmount(word string) (float64, string, bool) {
+	m := amountPattern.FindStringSubmatch(strings.ToLower(word))
+	if m == nil {
+		return 0, "", false
+	}
+	quantity, err := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+	if err != nil || quantity <= 0 {
+		return 0, "", false
+	}
+	switch m[2] {
+	case "", "x", "х", "×":
+		return quantity, "", true
+	}
+	unit, ok := normaliseUnit(m[2])
+	if !ok {
+		return 0, "", false
+	}
+	return quantity, unit, true
+}
+
+// parseQuantity splits free text like "2 kg apples", "молоко 1л" or "eggs x12"
+// into name, quantity and unit. Text without an amount is returned as is with zero quantity,
+// text holding nothing but an amount, like "2 kg", has an empty name.
+func parseQuantity(text string) (string, float64, string) {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return "", 0, ""
+	}
+	// leading amount: "2 kg apples", "2kg apples", "2 apples"
+	if quantity, unit, ok := parseAmount(words[0]); ok {
+		rest := words[1:]
+		if unit == "" && len(rest) > 0 {
+			if u, ok := normaliseUnit(rest[0]); ok {
+				unit, rest = u, rest[1:]
+			}
+		}
+		return strings.Join(rest, " "), quantity, unit
+	}
+	// trailing amount: "молоко 1л", "eggs x12", "apples 2 kg"
+	last := len(words) - 1
+	if quantity, unit, ok := parseAmount(words[last]); ok {
+		return strings.Join(words[:last], " "), quantity, unit
+	}
+	if unit, ok := normaliseUnit(words[last]); ok && len(words) > 2 {
+		if quantity, u, ok := parseAmount(words[last-1]); ok && u == "" {
+			return strings.Join(words[:last-1], " "), quantity, unit
+		}
+	}
+	return strings.TrimSpace(text), 0, ""
+}
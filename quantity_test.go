@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		text     string
+		name     string
+		quantity float64
+		unit     string
+	}{
+		{"2 kg apples", "apples", 2, "kg"},
+		{"2kg apples", "apples", 2, "kg"},
+		{"2 apples", "apples", 2, ""},
+		{"1,5 l milk", "milk", 1.5, "l"},
+		{"молоко 1л", "молоко", 1, "l"},
+		{"молоко 1 литр", "молоко", 1, "l"},
+		{"eggs x12", "eggs", 12, ""},
+		{"eggs 12x", "eggs", 12, ""},
+		{"apples 2 kg", "apples", 2, "kg"},
+		{"2 Bottles of wine", "of wine", 2, "bottle"},
+		// nothing but an amount has no name
+		{"2 kg", "", 2, "kg"},
+		{"100 g", "", 100, "g"},
+		{"2kg", "", 2, "kg"},
+		{"12", "", 12, ""},
+		// no amount
+		{"milk", "milk", 0, ""},
+		{"  oat  milk ", "oat  milk", 0, ""},
+		{"7up", "7up", 0, ""},
+		{"kg", "kg", 0, ""},
+		{"0 apples", "0 apples", 0, ""},
+		{"apples 2 boxes", "apples 2 boxes", 0, ""},
+		{"", "", 0, ""},
+	}
+	for _, tt := range tests {
+		name, quantity, unit := parseQuantity(tt.text)
+		if name != tt.name || quantity != tt.quantity || unit != tt.unit {
+			t.Errorf("parseQuantity(%q) = %q, %v, %q, want %q, %v, %q", tt.text, name, quantity, unit, tt.name, tt.quantity, tt.unit)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	// normalised forms are spellings of themselves
+	for spelling, unit := range units {
+		if normalised, ok := units[unit]; !ok || normalised != unit {
+			t.Errorf("%q is normalised to %q, which is not a unit", spelling, unit)
+		}
+	}
+	tests := []struct{ unit, canonical string }{
+		{"kg", "kg"},
+		{"KG", "kg"},
+		{"Kilos", "kg"},
+		{"литров", "l"},
+		{"шт.", "pcs"},
+		{"box", "box"},
+		{" jar ", "jar"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if canonical := canonicalUnit(tt.unit); canonical != tt.canonical {
+			t.Errorf("canonicalUnit(%q) = %q, want %q", tt.unit, canonical, tt.canonical)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rs/zerolog/log"
+)
+
+// RedisStore keeps items of every namespace in a single hash,
+// see RequestContext.buildNamespaceKey
+type RedisStore struct {
+	pool *redis.Pool
+}
+
+func newRedisStore(pool *redis.Pool) *RedisStore {
+	return &RedisStore{pool: pool}
+}
+
+func (s *RedisStore) List(rc *RequestContext) ([]Item, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("HVALS", rc.buildNamespaceKey()))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(values))
+	for _, value := range values {
+		var item Item
+		if err := json.Unmarshal(value, &item); err != nil {
+			log.Warn().Err(err).Str("key", rc.buildNamespaceKey()).Msg("Unable to unmarshal item")
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s *RedisStore) Get(rc *RequestContext, uid string) (Item, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var item Item
+	itemRaw, err := redis.Bytes(conn.Do("HGET", rc.buildNamespaceKey(), uid))
+	if err == redis.ErrNil {
+		return item, ErrItemNotFound
+	}
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(itemRaw, &item)
+	return item, err
+}
+
+// Create watches the namespace hash like Update, the sequence of its event
+// is taken in the same transaction
+func (s *RedisStore) Create(rc *RequestContext, item Item, event *Message) (Item, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	namespaceKey := rc.buildNamespaceKey()
+	created := item
+	for i := 0; i < maxUpdateRetries; i++ {
+		created = item
+		if _, err := conn.Do("WATCH", namespaceKey, eventSeqKey(rc)); err != nil {
+			return created, err
+		}
+		exists, err := redis.Bool(conn.Do("HEXISTS", namespaceKey, item.UID))
+		if err == nil && exists {
+			err = ErrItemExists
+		}
+		var data, eventData []byte
+		if err == nil {
+			created.bump()
+			data, err = json.Marshal(created)
+		}
+		if err == nil {
+			eventData, err = prepareEvent(conn, rc, event, &created)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return created, err
+		}
+		conn.Send("MULTI")
+		conn.Send("HSET", namespaceKey, created.UID, data)
+		sendEvent(conn, rc, event, eventData)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return created, err
+		}
+		if reply != nil {
+			return created, nil
+		}
+	}
+	return created, ErrConflict
+}
+
+// Update uses optimistic locking: the namespace hash and the sequence of
+// its events are watched while the item is modified and the whole thing
+// is retried if either was changed
+func (s *RedisStore) Update(rc *RequestContext, uid string, fn func(item *Item) error, event *Message) (Item, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	namespaceKey := rc.buildNamespaceKey()
+	var item Item
+	for i := 0; i < maxUpdateRetries; i++ {
+		item = Item{}
+		if _, err := conn.Do("WATCH", namespaceKey, eventSeqKey(rc)); err != nil {
+			return item, err
+		}
+		itemRaw, err := redis.Bytes(conn.Do("HGET", namespaceKey, uid))
+		if err == redis.ErrNil {
+			conn.Do("UNWATCH")
+			return item, ErrItemNotFound
+		}
+		if err == nil {
+			err = json.Unmarshal(itemRaw, &item)
+		}
+		if err == nil {
+			err = fn(&item)
+		}
+		var data, eventData []byte
+		if err == nil {
+			item.bump()
+			data, err = json.Marshal(item)
+		}
+		if err == nil {
+			eventData, err = prepareEvent(conn, rc, event, &item)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return item, err
+		}
+		conn.Send("MULTI")
+		conn.Send("HSET", namespaceKey, uid, data)
+		sendEvent(conn, rc, event, eventData)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return item, err
+		}
+		// nil reply means the watched key was modified, try again
+		if reply != nil {
+			return item, nil
+		}
+	}
+	return item, ErrConflict
+}
+
+func (s *RedisStore) Delete(rc *RequestContext, uid string, check func(item Item) error, event *Message) (Item, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	namespaceKey := rc.buildNamespaceKey()
+	var item Item
+	for i := 0; i < maxUpdateRetries; i++ {
+		item = Item{}
+		if _, err := conn.Do("WATCH", namespaceKey, eventSeqKey(rc)); err != nil {
+			return item, err
+		}
+		itemRaw, err := redis.Bytes(conn.Do("HGET", namespaceKey, uid))
+		if err == redis.ErrNil {
+			conn.Do("UNWATCH")
+			return item, ErrItemNotFound
+		}
+		if err == nil {
+			err = json.Unmarshal(itemRaw, &item)
+		}
+		if err == nil {
+			err = check(item)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return item, err
+		}
+		data, err := json.Marshal(item.trashed())
+		var eventData []byte
+		if err == nil {
+			eventData, err = prepareEvent(conn, rc, event, &item)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return item, err
+		}
+		conn.Send("MULTI")
+		conn.Send("HSET", rc.buildTrashKey(), uid, data)
+		conn.Send("HDEL", namespaceKey, uid)
+		sendEvent(conn, rc, event, eventData)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return item, err
+		}
+		if reply != nil {
+			return item, nil
+		}
+	}
+	return item, ErrConflict
+}
+
+func (s *RedisStore) Trash(rc *RequestContext) ([]Item, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	trashKey := rc.buildTrashKey()
+	values, err := redis.ByteSlices(conn.Do("HVALS", trashKey))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(values))
+	for _, value := range values {
+		var item Item
+		if err := json.Unmarshal(value, &item); err != nil {
+			log.Warn().Err(err).Str("key", trashKey).Msg("Unable to unmarshal item")
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Restore watches both the trash and the namespace hash, like Update
+func (s *RedisStore) Restore(rc *RequestContext, uid string, event *Message) (Item, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	namespaceKey, trashKey := rc.buildNamespaceKey(), rc.buildTrashKey()
+	var item Item
+	for i := 0; i < maxUpdateRetries; i++ {
+		item = Item{}
+		if _, err := conn.Do("WATCH", namespaceKey, trashKey, eventSeqKey(rc)); err != nil {
+			return item, err
+		}
+		itemRaw, err := redis.Bytes(conn.Do("HGET", trashKey, uid))
+		if err == redis.ErrNil {
+			conn.Do("UNWATCH")
+			return item, ErrItemNotFound
+		}
+		if err == nil {
+			err = json.Unmarshal(itemRaw, &item)
+		}
+		if err == nil {
+			var exists bool
+			exists, err = redis.Bool(conn.Do("HEXISTS", namespaceKey, uid))
+			if err == nil && exists {
+				err = ErrItemExists
+			}
+		}
+		var data, eventData []byte
+		if err == nil {
+			item.DeletedAt = nil
+			item.bump()
+			data, err = json.Marshal(item)
+		}
+		if err == nil {
+			eventData, err = prepareEvent(conn, rc, event, &item)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return item, err
+		}
+		conn.Send("MULTI")
+		conn.Send("HSET", namespaceKey, uid, data)
+		conn.Send("HDEL", trashKey, uid)
+		sendEvent(conn, rc, event, eventData)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return item, err
+		}
+		if reply != nil {
+			return item, nil
+		}
+	}
+	return item, ErrConflict
+}
+
+// Purge scans every trash hash, it is not atomic: an item deleted again
+// right while its hash is scanned may be purged too early
+func (s *RedisStore) Purge(before time.Time) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	purged := 0
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "trash:*", "COUNT", 1000))
+		if err != nil {
+			return purged, err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return purged, err
+		}
+		for _, key := range keys {
+			hash, err := redis.StringMap(conn.Do("HGETALL", key))
+			if err != nil {
+				return purged, err
+			}
+			for uid, value := range hash {
+				var item Item
+				if err := json.Unmarshal([]byte(value), &item); err == nil && item.DeletedAt != nil && !item.DeletedAt.Before(before) {
+					continue
+				}
+				if _, err := conn.Do("HDEL", key, uid); err != nil {
+					return purged, err
+				}
+				purged++
+			}
+		}
+		if cursor == 0 {
+			return purged, nil
+		}
+	}
+}
+
+// Record pushes entries to a list per namespace, the latest first
+func (s *RedisStore) Record(rc *RequestContext, entry AuditEntry) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	historyKey := rc.buildHistoryKey()
+	conn.Send("MULTI")
+	conn.Send("LPUSH", historyKey, data)
+	conn.Send("LTRIM", historyKey, 0, historySize-1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (s *RedisStore) History(rc *RequestContext) ([]AuditEntry, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	historyKey := rc.buildHistoryKey()
+	values, err := redis.ByteSlices(conn.Do("LRANGE", historyKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, 0, len(values))
+	for _, value := range values {
+		var entry AuditEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			log.Warn().Err(err).Str("key", historyKey).Msg("Unable to unmarshal audit entry")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *RedisStore) GetMeta(rc *RequestContext, name string) ([]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("HGET", rc.buildMetaKey(), name))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (s *RedisStore) SetMeta(rc *RequestContext, name string, value []byte) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", rc.buildMetaKey(), name, value)
+	return err
+}
+
+// UpdateMeta uses optimistic locking on the meta hash, like Update
+func (s *RedisStore) UpdateMeta(rc *RequestContext, name string, fn func(value []byte) ([]byte, error), event *Message) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	metaKey := rc.buildMetaKey()
+	for i := 0; i < maxUpdateRetries; i++ {
+		if _, err := conn.Do("WATCH", metaKey, eventSeqKey(rc)); err != nil {
+			return err
+		}
+		value, err := redis.Bytes(conn.Do("HGET", metaKey, name))
+		if err == redis.ErrNil {
+			value, err = nil, nil
+		}
+		if err == nil {
+			value, err = fn(value)
+		}
+		var eventData []byte
+		if err == nil {
+			eventData, err = prepareEvent(conn, rc, event, nil)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		conn.Send("MULTI")
+		conn.Send("HSET", metaKey, name, value)
+		sendEvent(conn, rc, event, eventData)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+	}
+	return ErrConflict
+}
+
+func (s *RedisStore) Close() error {
+	return s.pool.Close()
+}
+
+// migrate moves items stored as separate keys (item:g:default:<uid>)
+// into namespace hashes. Items already present in a hash are left untouched.
+func (s *RedisStore) migrate() (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	migrated := 0
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "item:*", "COUNT", 1000))
+		if err != nil {
+			return migrated, err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return migrated, err
+		}
+		for _, key := range keys {
+			namespaceKey, uid, ok := parseLegacyKey(key)
+			if !ok {
+				continue
+			}
+			value, err := redis.Bytes(conn.Do("GET", key))
+			if err == redis.ErrNil {
+				continue
+			}
+			if _, ok := err.(redis.Error); ok {
+				log.Warn().Err(err).Str("key", key).Msg("Skipping key during migration")
+				continue
+			}
+			if err != nil {
+				return migrated, err
+			}
+			conn.Send("MULTI")
+			conn.Send("HSETNX", namespaceKey, uid, value)
+			conn.Send("DEL", key)
+			if _, err := conn.Do("EXEC"); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+		if cursor == 0 {
+			return migrated, nil
+		}
+	}
+}
+
+// Events are kept in a sorted set per namespace scored by sequence,
+// the sequence itself is a counter next to it. Changes watch the counter
+// and write both in their transaction, so events follow the order of
+// changes and a change is never kept without its event.
+func eventSeqKey(rc *RequestContext) string {
+	return "seq:" + rc.namespaceID()
+}
+
+// prepareEvent stamps event with the sequence following the watched one
+func prepareEvent(conn redis.Conn, rc *RequestContext, event *Message, item *Item) ([]byte, error) {
+	if event == nil {
+		return nil, nil
+	}
+	seq, err := redis.Int64(conn.Do("GET", eventSeqKey(rc)))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	event.stamp(rc, seq+1, item)
+	return json.Marshal(event)
+}
+
+// sendEvent queues writes of a prepared event into a transaction
+func sendEvent(conn redis.Conn, rc *RequestContext, event *Message, data []byte) {
+	if event == nil {
+		return
+	}
+	changesKey := "changes:" + event.Namespace
+	conn.Send("SET", eventSeqKey(rc), event.Seq)
+	conn.Send("ZADD", changesKey, event.Seq, data)
+	conn.Send("ZREMRANGEBYRANK", changesKey, 0, -changeLogSize-1)
+}
+
+func (s *RedisStore) Seq(namespace string) (int64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	seq, err := redis.Int64(conn.Do("GET", "seq:"+namespace))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func (s *RedisStore) Since(namespace string, seq int64) ([]json.RawMessage, bool, error) {
+	current, err := s.Seq(namespace)
+	if err != nil {
+		return nil, false, err
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if seq > current {
+		return nil, false, nil
+	}
+	if seq == current {
+		return nil, true, nil
+	}
+	values, err := redis.Values(conn.Do("ZRANGEBYSCORE", "changes:"+namespace, seq+1, "+inf", "WITHSCORES"))
+	if err != nil {
+		return nil, false, err
+	}
+	events := make([]json.RawMessage, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		// events have to follow seq and each other without gaps,
+		// the oldest kept one may already be past seq
+		score, err := redis.Int64(values[i+1], nil)
+		if err != nil || score != seq+1+int64(len(events)) {
+			return nil, false, err
+		}
+		data, err := redis.Bytes(values[i], nil)
+		if err != nil {
+			return nil, false, err
+		}
+		events = append(events, data)
+	}
+	if seq+int64(len(events)) < current {
+		return nil, false, nil
+	}
+	return events, true, nil
+}
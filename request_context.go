@@ -1,9 +1,10 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/gorilla/websocket"
 )
 
 type RequestContext struct {
@@ -24,26 +25,87 @@ func getRequestContext(r *http.Request) *RequestContext {
 	}
 }
 
+// wsProtocolTokenPrefix marks a websocket subprotocol carrying auth token,
+// browsers can not set custom headers during websocket handshake
+const wsProtocolTokenPrefix = "token."
+
+// getStreamRequestContext is getRequestContext for websocket handshakes and event streams,
+// which browsers open without custom headers. The auth token is taken from the header,
+// "token" query param, "token" cookie or a websocket subprotocol.
+// The subprotocol which carried the token, if any, is returned to be accepted.
+func getStreamRequestContext(r *http.Request) (*RequestContext, string) {
+	query := r.URL.Query()
+	authToken, protocol := r.Header.Get(authTokenHeader), ""
+	if authToken == "" {
+		authToken = query.Get("token")
+	}
+	if authToken == "" {
+		if cookie, err := r.Cookie("token"); err == nil {
+			authToken = cookie.Value
+		}
+	}
+	if authToken == "" {
+		for _, p := range websocket.Subprotocols(r) {
+			if strings.HasPrefix(p, wsProtocolTokenPrefix) {
+				authToken, protocol = strings.TrimPrefix(p, wsProtocolTokenPrefix), p
+				break
+			}
+		}
+	}
+	user := users[authToken]
+	return &RequestContext{
+		User:            &user,
+		Namespace:       query.Get("namespace"),
+		NamespacePrefix: query.Get("namespace_prefix"),
+	}, protocol
+}
+
 func (rc *RequestContext) isAuthorized() bool {
 	return rc.User.Username != ""
 }
 
-// item:g:default:qwer-asdf-1234asdf - global keys in default namespace
-// item:my:user:work:zcxv-asdf-qwer - user specific keys in work namespace
-func (rc *RequestContext) buidlKey(uid string) string {
-	keyParts := []string{"item", rc.NamespacePrefix}
+// g:default - global default namespace
+// my:user:work - user specific work namespace
+func (rc *RequestContext) namespaceID() string {
+	keyParts := []string{rc.NamespacePrefix}
 	if rc.NamespacePrefix == "my" {
 		keyParts = append(keyParts, rc.User.Username)
 	}
 	keyParts = append(keyParts, rc.Namespace)
-	if uid != "" {
-		keyParts = append(keyParts, uid)
-	}
 	return strings.Join(keyParts, ":")
 }
 
-func (rc *RequestContext) buildKeyPattern() string {
-	// to make sure we are not building pattern with item uid
-	key := rc.buidlKey("")
-	return fmt.Sprintf("%s:*", key)
+// items:g:default - a hash of global items in default namespace
+// items:my:user:work - a hash of user specific items in work namespace
+// Fields of the hash are item uids and values are json encoded items.
+func (rc *RequestContext) buildNamespaceKey() string {
+	return "items:" + rc.namespaceID()
+}
+
+// trash:g:default - a hash of deleted items, laid out like the items hash
+func (rc *RequestContext) buildTrashKey() string {
+	return "trash:" + rc.namespaceID()
+}
+
+// history:g:default - audit entries, see AuditLog
+func (rc *RequestContext) buildHistoryKey() string {
+	return "history:" + rc.namespaceID()
+}
+
+// meta:g:default - a hash of json documents describing the namespace, see MetaStore
+func (rc *RequestContext) buildMetaKey() string {
+	return "meta:" + rc.namespaceID()
+}
+
+// parseLegacyKey converts a key from the layout used before namespace hashes
+// (item:g:default:qwer-asdf-1234asdf) into the namespace hash key and item uid
+func parseLegacyKey(key string) (namespaceKey string, uid string, ok bool) {
+	if !strings.HasPrefix(key, "item:") {
+		return "", "", false
+	}
+	i := strings.LastIndex(key, ":")
+	if i <= len("item") {
+		return "", "", false
+	}
+	return "items" + key[len("item"):i], key[i+1:], true
 }
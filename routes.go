@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Route is an entry of the /items routes table. The same table registers
+// handlers on itemsMux and describes them in the OpenAPI document,
+// so a route can not be served without being documented.
+type Route struct {
+	Path    string
+	Method  string
+	Summary string
+	Query   []QueryParam
+	// IfMatch marks routes checking the If-Match header against the item version
+	IfMatch bool
+	// Body and Response are zero values of the request and response types, nil if there is none
+	Body     interface{}
+	Response interface{}
+	Handler  func(*Handlers, http.ResponseWriter, *http.Request)
+}
+
+type QueryParam struct {
+	Name        string
+	Description string
+	Required    bool
+	// Example is also used to derive the parameter type
+	Example interface{}
+}
+
+var uidParam = QueryParam{Name: "uid", Description: "Item uid", Required: true, Example: ""}
+
+var itemsRoutes = []Route{
+	{
+		Path:    "/add",
+		Method:  http.MethodGet,
+		Summary: "Add an item",
+		Query: []QueryParam{
+			{Name: "name", Description: "Item name", Required: true, Example: ""},
+			{Name: "category", Description: "Item category", Example: ""},
+			{Name: "note", Description: "Free text note", Example: ""},
+		},
+		Response: Item{},
+		Handler:  (*Handlers).AddItemHandler,
+	},
+	{
+		Path:    "/delete",
+		Method:  http.MethodGet,
+		Summary: "Move an item to the trash",
+		Query:   []QueryParam{uidParam},
+		IfMatch: true,
+		Handler: (*Handlers).DeleteItemHandler,
+	},
+	{
+		Path:    "/edit",
+		Method:  http.MethodGet,
+		Summary: "Change name and category of an item",
+		Query: []QueryParam{
+			uidParam,
+			{Name: "name", Description: "Item name", Required: true, Example: ""},
+			{Name: "category", Description: "Item category", Example: ""},
+			{Name: "note", Description: "Free text note, left as is when missing", Example: ""},
+		},
+		IfMatch:  true,
+		Response: Item{},
+		Handler:  (*Handlers).EditItemHandler,
+	},
+	{
+		Path:     "/toggle",
+		Method:   http.MethodGet,
+		Summary:  "Check or uncheck an item",
+		Query:    []QueryParam{uidParam},
+		IfMatch:  true,
+		Response: Item{},
+		Handler:  (*Handlers).ToggleItemHandler,
+	},
+	{
+		Path:    "/changes",
+		Method:  http.MethodGet,
+		Summary: "Get changes made after the cursor",
+		Query: []QueryParam{
+			{Name: "since", Description: "Cursor of the previous response, 0 for everything", Required: true, Example: int64(0)},
+		},
+		Response: ChangesResponse{},
+		Handler:  (*Handlers).ChangesHandler,
+	},
+	{
+		Path:     "/sync",
+		Method:   http.MethodPost,
+		Summary:  "Apply changes made offline",
+		Body:     SyncRequest{},
+		Response: SyncResponse{},
+		Handler:  (*Handlers).SyncHandler,
+	},
+	{
+		Path:    "/move",
+		Method:  http.MethodPost,
+		Summary: "Put an item right before or after another one, it joins the category of that one",
+		Query: []QueryParam{
+			uidParam,
+			{Name: "before", Description: "Uid of the item to put it before", Example: ""},
+			{Name: "after", Description: "Uid of the item to put it after", Example: ""},
+		},
+		IfMatch:  true,
+		Response: Item{},
+		Handler:  (*Handlers).MoveItemHandler,
+	},
+	{
+		Path:     "/categories",
+		Method:   http.MethodGet,
+		Summary:  "Get the category order",
+		Response: CategoryOrder{},
+		Handler:  (*Handlers).CategoriesHandler,
+	},
+	{
+		Path:     "/stores",
+		Method:   http.MethodGet,
+		Summary:  "List store profiles",
+		Response: []StoreProfile{},
+		Handler:  (*Handlers).StoresHandler,
+	},
+	{
+		Path:     "/trash",
+		Method:   http.MethodGet,
+		Summary:  "List deleted items, the latest deleted first",
+		Response: []Item{},
+		Handler:  (*Handlers).TrashHandler,
+	},
+	{
+		Path:     "/restore",
+		Method:   http.MethodPost,
+		Summary:  "Move an item out of the trash",
+		Query:    []QueryParam{uidParam},
+		Response: Item{},
+		Handler:  (*Handlers).RestoreItemHandler,
+	},
+	{
+		Path:    "/history",
+		Method:  http.MethodGet,
+		Summary: "List recent changes of items, the latest first",
+		Query: []QueryParam{
+			{Name: "uid", Description: "Item uid, changes of every item when missing", Example: ""},
+		},
+		Response: []AuditEntry{},
+		Handler:  (*Handlers).HistoryHandler,
+	},
+	{
+		Path:     "/presence",
+		Method:   http.MethodGet,
+		Summary:  "List users looking at the namespace through this instance",
+		Response: PresenceResponse{},
+		Handler:  (*Handlers).PresenceHandler,
+	},
+	{
+		Path:    "/",
+		Method:  http.MethodGet,
+		Summary: "List items",
+		Query: []QueryParam{
+			{Name: "store", Description: "Name of a store profile to order categories by its aisles", Example: ""},
+		},
+		Response: []Item{},
+		Handler:  (*Handlers).ItemsHandler,
+	},
+}
+
+// newItemsMux serves itemsRoutes, it is mounted at /items
+func newItemsMux(h *Handlers) *http.ServeMux {
+	mux := http.NewServeMux()
+	registerRoutes(mux, h, itemsRoutes)
+	return mux
+}
+
+// registerRoutes serves every route only with its method,
+// routes sharing a path are served by a single handler
+func registerRoutes(mux *http.ServeMux, h *Handlers, routes []Route) {
+	byPath := map[string]map[string]func(*Handlers, http.ResponseWriter, *http.Request){}
+	var paths []string
+	for _, route := range routes {
+		if _, ok := byPath[route.Path]; !ok {
+			byPath[route.Path] = map[string]func(*Handlers, http.ResponseWriter, *http.Request){}
+			paths = append(paths, route.Path)
+		}
+		byPath[route.Path][route.Method] = route.Handler
+	}
+	for _, path := range paths {
+		handlers := byPath[path]
+		var allowed []string
+		for method := range handlers {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			handler, ok := handlers[r.Method]
+			if !ok {
+				writeMethodNotAllowed(w, r, allowed...)
+				return
+			}
+			handler(h, w, r)
+		})
+	}
+}
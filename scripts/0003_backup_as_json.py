@@ -3,7 +3,10 @@
 # This script makes a backup of all keys 
 # and their data in json format.
 # It creates items.json with the following format:
-# [{"key": "item:g:default:123-asdf-3546-zxcv", "value": "some-utf-encoded-data"]
+# [{"key": "items:g:default", "type": "hash", "value": {"123-asdf-3546-zxcv": "some-utf-encoded-data"}}]
+# Values of hashes (items:*, trash:*, meta:*) are objects, lists (history:*)
+# are arrays, sorted sets (changes:*) are arrays of [member, score]
+# and strings (seq:*, legacy item:*) are kept as is.
 
 import json
 import os
@@ -11,16 +14,37 @@ import subprocess
 
 
 redis_port = os.getenv("REDIS_PORT", "6379")
+
+
+def redis(*args):
+    proc = subprocess.run(["redis-cli", "-p", redis_port, "-c", *args], capture_output=True)
+    # values are compact json, so they never span several lines
+    lines = proc.stdout.decode("utf-8").split("\n")
+    if lines and lines[-1] == "":
+        lines.pop()
+    return lines
+
+
 result = []
 
-keys_proc = subprocess.run(["redis-cli", "-p", redis_port, "-c", "keys", "*"], capture_output=True)
-for key in keys_proc.stdout.decode("utf-8").split("\n"):
-    data_proc = subprocess.run(["redis-cli", "-p", redis_port, "-c", "get", key], capture_output=True)
-    for raw_data in data_proc.stdout.decode("utf-8").split("\n"):
-        if not raw_data:
-            continue
-        result.append({"key": key, "value": raw_data})
+for key in redis("keys", "*"):
+    if not key:
+        continue
+    key_type = redis("type", key)[0]
+    if key_type == "string":
+        value = redis("get", key)[0]
+    elif key_type == "hash":
+        pairs = redis("hgetall", key)
+        value = dict(zip(pairs[0::2], pairs[1::2]))
+    elif key_type == "list":
+        value = redis("lrange", key, "0", "-1")
+    elif key_type == "zset":
+        pairs = redis("zrange", key, "0", "-1", "withscores")
+        value = [[member, score] for member, score in zip(pairs[0::2], pairs[1::2])]
+    else:
+        print(f"skipping {key} of type {key_type}")
+        continue
+    result.append({"key": key, "type": key_type, "value": value})
 
 with open("items.json", "w") as f:
     json.dump(result, f, ensure_ascii=False)
-
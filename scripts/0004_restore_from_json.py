@@ -1,7 +1,8 @@
 #!/bin/env/python3
 
 # This script restores data from items.json produced by
-# 0003_backup_as_json.py
+# 0003_backup_as_json.py, backups made before keys had types
+# are restored as strings. Every restored key is replaced as a whole.
 
 import json
 import os
@@ -12,8 +13,22 @@ redis_port = os.getenv("REDIS_PORT", "6379")
 f = open('items.json')
 items = json.load(f)
 
-# TODO: clear the storage before restoration?
 
-for item in items:
-    subprocess.run(["redis-cli", "-p", redis_port, "-c", "set", item["key"], item["value"]])
+def redis(*args):
+    subprocess.run(["redis-cli", "-p", redis_port, "-c", *args])
+
 
+for item in items:
+    key, key_type, value = item["key"], item.get("type", "string"), item["value"]
+    redis("del", key)
+    if key_type == "string":
+        redis("set", key, value)
+    elif key_type == "hash":
+        for field, field_value in value.items():
+            redis("hset", key, field, field_value)
+    elif key_type == "list":
+        for element in value:
+            redis("rpush", key, element)
+    elif key_type == "zset":
+        for member, score in value:
+            redis("zadd", key, score, member)
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventsHandler streams hub events of a namespace as Server-Sent Events.
+// The stream is registered on the hub as a client without a websocket connection,
+// event ids are sequence numbers, so Last-Event-ID resumes where the stream stopped.
+func (h *Handlers) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	rc, _ := getStreamRequestContext(r)
+	if ok := rc.isAuthorized(); !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	data := namespaceData{NamespacePrefix: rc.NamespacePrefix, Namespace: rc.Namespace}
+	rc, err := data.requestContext(rc.User)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, errors.New("response writer does not support flushing"))
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("since")
+	}
+	since, err := strconv.ParseInt(lastEventID, 10, 64)
+	if err != nil {
+		since = -1
+	}
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		clientID = uuid.NewString()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client := &Client{
+		id:         clientID,
+		hub:        h.hub,
+		handlers:   h,
+		send:       make(chan []byte, 256),
+		user:       rc.User,
+		namespaces: map[string]bool{},
+	}
+	h.hub.register <- client
+	h.hub.subscriptions <- subscription{client: client, namespace: rc.namespaceID(), active: true, since: since}
+	defer func() {
+		h.hub.unregister <- client
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				return
+			}
+			if err := writeServerSentEvent(w, message); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			// comments keep proxies from closing an idle stream
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, message []byte) error {
+	var msg struct {
+		Seq int64 `json:"seq"`
+	}
+	json.Unmarshal(message, &msg)
+	if msg.Seq > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", msg.Seq); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "data: %s\n\n", message)
+	return err
+}
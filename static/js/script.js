@@ -4,7 +4,9 @@ if (loc.protocol === "https:") {
   scheme = "wss";
 }
 const clientID = Math.floor(100000 + Math.random() * 900000);
-let socket = new WebSocket(`${scheme}://${loc.host}/ws?client_id=${clientID}`);
+let socket = null;
+// sequence of the last event seen in the current namespace, used to replay missed events
+let lastSeq = null;
 
 const app = Vue.createApp({
   data() {
@@ -21,12 +23,19 @@ const app = Vue.createApp({
       editItemUid: null,
       editItemName: "",
       editItemCategory: "",
+      editItemNote: "",
       editItemError: "",
       suggestedCategories: [],
       token: "",
       rawToken: "",
       namespacePrefix: "",
       namespace: "",
+      viewers: [],
+      categoryOrder: [],
+      stores: [],
+      storeName: localStorage.getItem("store") || "",
+      // the last deleted item, offered for undo for a few seconds
+      deletedItem: null,
     };
   },
   computed: {
@@ -43,7 +52,7 @@ const app = Vue.createApp({
       return ["all"];
     },
     filteredItems() {
-      let items = this.items.slice();
+      let items = this.items.slice().sort(this.compareItems);
       if (this.searchText.length > 0) {
         items = items.filter((item) =>
           item.name.toLowerCase().includes(this.searchText.toLowerCase())
@@ -67,6 +76,16 @@ const app = Vue.createApp({
     isEditItemModeUpdate() {
       return this.editItemMode === "update";
     },
+    // categories follow aisles of the selected store, see StoreProfile
+    activeCategoryOrder() {
+      let store = this.stores.find((s) => s.name === this.storeName);
+      if (!store) {
+        return this.categoryOrder;
+      }
+      return Object.keys(store.aisles).sort((a, b) =>
+        store.aisles[a] - store.aisles[b] || (a < b ? -1 : a > b ? 1 : 0)
+      );
+    },
     isGlobalNamespace() {
       return this.namespace === "default" && this.namespacePrefix === "g";
     },
@@ -78,6 +97,10 @@ const app = Vue.createApp({
     isGrouped(val) {
       localStorage.setItem("isGrouped", val);
     },
+    storeName(val) {
+      localStorage.setItem("store", val);
+      this.loadItems();
+    },
   },
   methods: {
     saveToken() {
@@ -92,6 +115,124 @@ const app = Vue.createApp({
         "X-Namespace": this.namespace,
       };
     },
+    getItemHeaders(item) {
+      return { ...this.getHeaders(), "If-Match": `"${item.version}"` };
+    },
+    getNamespaceURL() {
+      return `/api/v1/namespaces/${encodeURIComponent(this.namespacePrefix)}/${encodeURIComponent(this.namespace)}`;
+    },
+    getItemsURL(uid) {
+      let url = `${this.getNamespaceURL()}/items`;
+      if (uid) {
+        url += `/${encodeURIComponent(uid)}`;
+      }
+      return url;
+    },
+    async getErrorMessage(res) {
+      try {
+        let data = await res.json();
+        return data.message;
+      } catch (e) {
+        return `${res.status} ${res.statusText}`;
+      }
+    },
+    formatAmount(item) {
+      if (!item.quantity) {
+        return "";
+      }
+      return item.unit ? `${item.quantity} ${item.unit}` : `${item.quantity}`;
+    },
+    describeItem(item) {
+      let lines = [];
+      if (item.created_by) {
+        lines.push(`Добавил ${item.created_by}`);
+      }
+      if (item.checked_by) {
+        lines.push(`Отметил ${item.checked_by} ${new Date(item.checked_at).toLocaleString()}`);
+      }
+      return lines.join("\n");
+    },
+    // same order as the server uses, see sortItems
+    compareItems(a, b) {
+      let rank = (category) => {
+        let idx = this.activeCategoryOrder.indexOf(category);
+        return idx === -1 ? this.activeCategoryOrder.length : idx;
+      };
+      if (rank(a.category) !== rank(b.category)) {
+        return rank(a.category) - rank(b.category);
+      }
+      if (a.category !== b.category) {
+        return a.category < b.category ? -1 : 1;
+      }
+      if (a.position !== b.position) {
+        if (!a.position || !b.position) {
+          return a.position ? -1 : 1;
+        }
+        return a.position < b.position ? -1 : 1;
+      }
+      // items of unknown age have no created_at, they go first
+      if (a.created_at !== b.created_at) {
+        return (a.created_at || "") < (b.created_at || "") ? -1 : 1;
+      }
+      return a.uid < b.uid ? -1 : 1;
+    },
+    async moveItem(direction) {
+      let item = this.findItem(this.editItemUid);
+      let siblings = this.items
+        .filter((i) => i.category === item.category)
+        .sort(this.compareItems);
+      let idx = siblings.findIndex((i) => i.uid === item.uid);
+      let body = {};
+      if (direction < 0 && idx > 0) {
+        body.before = siblings[idx - 1].uid;
+      } else if (direction > 0 && idx < siblings.length - 1) {
+        body.after = siblings[idx + 1].uid;
+      } else {
+        return;
+      }
+      let res = await fetch(`${this.getItemsURL(item.uid)}/move`, {
+        method: "POST",
+        headers: { ...this.getItemHeaders(item), "Content-Type": "application/json" },
+        body: JSON.stringify(body),
+      });
+      if (res.status === 412) {
+        this.editItemError = "Кто-то уже изменил этот элемент";
+        await this.loadItems();
+        return;
+      }
+      if (!res.ok) {
+        this.editItemError = await this.getErrorMessage(res);
+        return;
+      }
+      let data = await res.json();
+      item.category = data.category;
+      item.position = data.position;
+      item.version = data.version;
+    },
+    async moveCategory(category, direction) {
+      let categories = [...new Set(this.items.slice().sort(this.compareItems).map((i) => i.category))];
+      let idx = categories.indexOf(category);
+      let other = idx + direction;
+      if (other < 0 || other >= categories.length) {
+        return;
+      }
+      categories[idx] = categories[other];
+      categories[other] = category;
+      let res = await fetch(`${this.getNamespaceURL()}/categories`, {
+        method: "PUT",
+        headers: { ...this.getHeaders(), "Content-Type": "application/json" },
+        body: JSON.stringify({ categories: categories }),
+      });
+      if (!res.ok) {
+        console.warn(await this.getErrorMessage(res));
+        return;
+      }
+      let data = await res.json();
+      this.categoryOrder = data.categories;
+    },
+    findItem(uid) {
+      return this.items.find((i) => i.uid === uid);
+    },
     setNamespace() {
       let nsParts = window.location.hash.substring(2).split("/");
       if (nsParts.length !== 2) {
@@ -122,8 +263,10 @@ const app = Vue.createApp({
     showEditModal(item) {
       this.isModalShown = true;
       this.modalTitle = "Изменить";
-      this.editItemName = item.name;
+      // the server parses the amount back out of the name
+      this.editItemName = item.quantity ? `${this.formatAmount(item)} ${item.name}` : item.name;
       this.editItemCategory = item.category;
+      this.editItemNote = item.note;
       this.editItemMode = "update";
       this.editItemUid = item.uid;
     },
@@ -136,6 +279,7 @@ const app = Vue.createApp({
       this.editItemUid = null;
       this.editItemName = "";
       this.editItemCategory = "";
+      this.editItemNote = "";
       this.suggestedCategories = [];
     },
     itemsByCategory(category, is_checked) {
@@ -190,11 +334,21 @@ const app = Vue.createApp({
       }
     },
     async toggleRequest(item) {
-      let res = await fetch(`/items/toggle?uid=${item.uid}`, {
-        headers: this.getHeaders(),
+      let res = await fetch(this.getItemsURL(item.uid), {
+        method: "PATCH",
+        headers: { ...this.getItemHeaders(item), "Content-Type": "application/json" },
+        body: JSON.stringify({ is_checked: !item.is_checked }),
       });
+      if (res.status === 412) {
+        // someone else has changed the item in the meantime
+        await this.loadItems();
+        return;
+      }
       let data = await res.json();
       item.is_checked = data.is_checked;
+      item.checked_by = data.checked_by;
+      item.checked_at = data.checked_at;
+      item.version = data.version;
       if (item.is_checked) {
         item.state = "completed";
       } else {
@@ -203,24 +357,57 @@ const app = Vue.createApp({
       item.is_prechecked = false;
     },
     async removeItem() {
-      let res = await fetch(`/items/delete?uid=${this.editItemUid}`, {
-        headers: this.getHeaders(),
+      let res = await fetch(this.getItemsURL(this.editItemUid), {
+        method: "DELETE",
+        headers: this.getItemHeaders(this.findItem(this.editItemUid)),
       });
+      if (res.status === 412) {
+        this.editItemError = "Кто-то уже изменил этот элемент";
+        await this.loadItems();
+        return;
+      }
       if (!res.ok) {
-        this.editItemError = `${res.status} ${res.statusText}`;
+        this.editItemError = await this.getErrorMessage(res);
         return;
       }
       let idx = this.items.findIndex((i) => i.uid === this.editItemUid);
-      this.items.splice(idx, 1);
+      let deletedItem = this.items.splice(idx, 1)[0];
+      this.deletedItem = deletedItem;
+      setTimeout(() => {
+        if (this.deletedItem === deletedItem) {
+          this.deletedItem = null;
+        }
+      }, 10000);
       this.closeModal();
     },
+    async restoreItem() {
+      let uid = this.deletedItem.uid;
+      this.deletedItem = null;
+      let res = await fetch(`${this.getNamespaceURL()}/trash/${encodeURIComponent(uid)}/restore`, {
+        method: "POST",
+        headers: this.getHeaders(),
+      });
+      if (!res.ok) {
+        console.warn(await this.getErrorMessage(res));
+        return;
+      }
+      let data = await res.json();
+      if (this.items.findIndex((i) => i.uid === data.uid) === -1) {
+        this.items.push({ ...data, state: data.is_checked ? "completed" : "open" });
+      }
+    },
     async addItem() {
-      let res = await fetch(
-        `/items/add?name=${this.editItemName}&category=${this.editItemCategory}`,
-        { headers: this.getHeaders() }
-      );
+      let res = await fetch(this.getItemsURL(), {
+        method: "POST",
+        headers: { ...this.getHeaders(), "Content-Type": "application/json" },
+        body: JSON.stringify({
+          name: this.editItemName,
+          category: this.editItemCategory,
+          note: this.editItemNote,
+        }),
+      });
       if (!res.ok) {
-        this.editItemError = `${res.status} ${res.statusText}`;
+        this.editItemError = await this.getErrorMessage(res);
         return;
       }
       let data = await res.json();
@@ -228,22 +415,168 @@ const app = Vue.createApp({
       this.closeModal();
     },
     async updateItem() {
-      let res = await fetch(
-        `/items/edit?uid=${this.editItemUid}&name=${this.editItemName}&category=${this.editItemCategory}`,
-        { headers: this.getHeaders() }
-      );
+      let res = await fetch(this.getItemsURL(this.editItemUid), {
+        method: "PATCH",
+        headers: {
+          ...this.getItemHeaders(this.findItem(this.editItemUid)),
+          "Content-Type": "application/json",
+        },
+        // the amount is parsed back out of the name, zero clears it when there is none
+        body: JSON.stringify({
+          name: this.editItemName,
+          category: this.editItemCategory,
+          note: this.editItemNote,
+          quantity: 0,
+        }),
+      });
+      if (res.status === 412) {
+        this.editItemError = "Кто-то уже изменил этот элемент";
+        await this.loadItems();
+        return;
+      }
       if (!res.ok) {
-        this.editItemError = `${res.status} ${res.statusText}`;
+        this.editItemError = await this.getErrorMessage(res);
         return;
       }
+      let data = await res.json();
       let idx = this.items.findIndex((i) => i.uid === this.editItemUid);
-      this.items[idx].name = this.editItemName;
-      this.items[idx].category = this.editItemCategory;
+      this.items[idx].name = data.name;
+      this.items[idx].category = data.category;
+      this.items[idx].note = data.note;
+      this.items[idx].quantity = data.quantity;
+      this.items[idx].unit = data.unit;
+      this.items[idx].version = data.version;
       this.closeModal();
     },
+    connect() {
+      // the socket is scoped to the current namespace, so it is reopened when it changes
+      if (socket !== null) {
+        socket.onclose = null;
+        socket.close();
+      }
+      let params = new URLSearchParams({
+        client_id: clientID,
+        token: this.token,
+        namespace_prefix: this.namespacePrefix,
+        namespace: this.namespace,
+      });
+      if (lastSeq !== null) {
+        params.set("since", lastSeq);
+      }
+      socket = new WebSocket(`${scheme}://${loc.host}/ws?${params}`);
+      socket.addEventListener("open", function (e) {
+        console.log(e);
+      });
+      // e.g. a phone was locked, missed events are replayed after reconnect
+      socket.onclose = () => {
+        setTimeout(() => this.connect(), 1000);
+      };
+      socket.addEventListener("message", (raw) => {
+        // the server may pack several events into one frame
+        for (let line of raw.data.split("\n")) {
+          this.handleEvent(JSON.parse(line));
+        }
+      });
+    },
+    handleEvent(event) {
+      let idx = null;
+      if (event.type === "error") {
+        console.warn(event.error);
+        return
+      }
+      if (event.type === "presence") {
+        this.viewers = event.data.viewers;
+        return
+      }
+      if (event.type === "resync") {
+        lastSeq = null;
+        this.loadItems();
+        return
+      }
+      if (event.seq) {
+        lastSeq = Math.max(lastSeq || 0, event.seq);
+      }
+      if (event.type === "reorder" && event.data && event.data.categories) {
+        this.categoryOrder = event.data.categories;
+        return
+      }
+      if (!event.data || !event.data.uid) {
+        return
+      }
+      if (event.data.namespace_prefix !== this.namespacePrefix) {
+        return
+      }
+      if (event.data.namespace !== this.namespace) {
+        return
+      }
+      idx = this.items.findIndex((i) => i.uid === event.data.uid);
+      // events may arrive out of order, the ones older than what we have are dropped
+      if (idx !== -1 && this.items[idx].version >= event.version && event.type !== "delete") {
+        return
+      }
+      switch (event.type) {
+        case "toggle":
+          if (idx === -1) {
+            return
+          }
+          let state = "open";
+          if (event.data.is_checked) {
+            state = "completed";
+          }
+          this.items[idx].is_checked = event.data.is_checked;
+          this.items[idx].checked_by = event.data.checked_by;
+          this.items[idx].checked_at = event.data.checked_at;
+          this.items[idx].state = state;
+          this.items[idx].version = event.version;
+          break;
+        case "edit":
+          if (idx === -1) {
+            return
+          }
+          this.items[idx].name = event.data.name;
+          this.items[idx].category = event.data.category;
+          this.items[idx].note = event.data.note;
+          this.items[idx].quantity = event.data.quantity;
+          this.items[idx].unit = event.data.unit;
+          this.items[idx].is_checked = event.data.is_checked;
+          this.items[idx].checked_by = event.data.checked_by;
+          this.items[idx].checked_at = event.data.checked_at;
+          this.items[idx].state = event.data.is_checked ? "completed" : "open";
+          this.items[idx].version = event.version;
+          break;
+        case "reorder":
+          if (idx === -1) {
+            return
+          }
+          this.items[idx].category = event.data.category;
+          this.items[idx].position = event.data.position;
+          this.items[idx].version = event.version;
+          break;
+        case "delete":
+          if (idx === -1) {
+            return
+          }
+          this.items.splice(idx, 1);
+          break;
+        case "add":
+        case "restore":
+          if (idx !== -1) {
+            return
+          }
+          this.items.push(Object.assign(event.data, { state: event.data.is_checked ? "completed" : "open" }));
+      }
+    },
     async loadItems() {
+      let categoriesRes = await fetch(`${this.getNamespaceURL()}/categories`, { headers: this.getHeaders() });
+      if (categoriesRes.ok) {
+        this.categoryOrder = (await categoriesRes.json()).categories;
+      }
+      let storesRes = await fetch(`${this.getNamespaceURL()}/stores`, { headers: this.getHeaders() });
+      if (storesRes.ok) {
+        this.stores = await storesRes.json();
+      }
       this.items = [];
-      let res = await fetch("items/", { headers: this.getHeaders() });
+      let res = await fetch(this.getItemsURL(), { headers: this.getHeaders() });
       let rawItems = await res.json();
       for (let item of rawItems) {
         let state = "open";
@@ -270,6 +603,9 @@ const app = Vue.createApp({
     window.onhashchange = async (_) => {
       await this.setNamespace();
       await this.loadItems();
+      lastSeq = null;
+      this.viewers = [];
+      this.connect();
     };
     await this.loadItems();
     // Load settings from local storage, if present
@@ -282,42 +618,7 @@ const app = Vue.createApp({
       this.isGrouped = JSON.parse(isGroupedLocalStorage);
     }
 
-    // websocket events mapping
-    socket.addEventListener("open", function (e) {
-      console.log(e);
-    });
-    socket.addEventListener("message", (raw) => {
-      let event = JSON.parse(raw.data);
-      let idx = null;
-      if (event.data.namespace_prefix !== this.namespacePrefix) {
-        return
-      }
-      if (event.data.namespace !== this.namespace) {
-        return
-      }
-      switch (event.type) {
-        case "toggle":
-          idx = this.items.findIndex((i) => i.uid === event.data.uid);
-          let state = "open";
-          if (event.data.is_checked) {
-            state = "completed";
-          }
-          this.items[idx].is_checked = event.data.is_checked;
-          this.items[idx].state = state;
-          break;
-        case "edit":
-          idx = this.items.findIndex((i) => i.uid === event.data.uid);
-          this.items[idx].name = event.data.name;
-          this.items[idx].category = event.data.category;
-          break;
-        case "delete":
-          idx = this.items.findIndex((i) => i.uid === event.data.uid);
-          this.items.splice(idx, 1);
-          break;
-        case "add":
-          this.items.push(Object.assign(event.data, { state: "open" }));
-      }
-    });
+    this.connect();
     this.loading = false;
   },
 });
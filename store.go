@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrItemNotFound = errors.New("item not found")
+	ErrItemExists   = errors.New("item already exists")
+	// ErrConflict is returned when an item kept changing concurrently
+	// and an update could not be applied after maxUpdateRetries attempts
+	ErrConflict = errors.New("item was modified concurrently")
+	// ErrVersionMismatch is returned by preconditions when a client
+	// tries to change an item version it has not seen
+	ErrVersionMismatch = errors.New("item version mismatch")
+)
+
+// StoreError is a failure of the storage backend itself, e.g. redis is down,
+// as opposed to the errors above which are answers about the data
+type StoreError struct {
+	Op  string
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	maxUpdateRetries = 5
+
+	// Number of recent events kept per namespace for replays
+	changeLogSize = 1000
+
+	// Number of audit entries kept per namespace, older ones are dropped
+	historySize = 1000
+)
+
+// Store is everything a storage backend provides
+type Store interface {
+	ItemStore
+	ChangeLog
+	MetaStore
+	AuditLog
+	Close() error
+}
+
+// ItemStore keeps items of a namespace described by RequestContext.
+// Changes take the event describing them, if any, and keep it in the
+// change log in the same transaction, see ChangeLog. The store sets its
+// namespace, sequence, version and data to the changed item.
+type ItemStore interface {
+	List(rc *RequestContext) ([]Item, error)
+	Get(rc *RequestContext, uid string) (Item, error)
+	// Create fails with ErrItemExists if there is an item with the same uid
+	Create(rc *RequestContext, item Item, event *Message) (Item, error)
+	// Update atomically applies fn to a stored item and saves the result,
+	// an error returned from fn aborts the update and is returned as is
+	Update(rc *RequestContext, uid string, fn func(item *Item) error, event *Message) (Item, error)
+	// Delete moves an item into the trash of its namespace if check passes
+	// and returns what was removed
+	Delete(rc *RequestContext, uid string, check func(item Item) error, event *Message) (Item, error)
+	// Trash lists deleted items of a namespace
+	Trash(rc *RequestContext) ([]Item, error)
+	// Restore moves an item out of the trash, it fails with ErrItemNotFound
+	// if it is not there and with ErrItemExists if its uid is taken again
+	Restore(rc *RequestContext, uid string, event *Message) (Item, error)
+	// Purge removes items deleted before the given time from every namespace
+	Purge(before time.Time) (int, error)
+}
+
+// AuditLog keeps the latest historySize changes of items of a namespace
+type AuditLog interface {
+	Record(rc *RequestContext, entry AuditEntry) error
+	// History returns entries of a namespace, the latest first
+	History(rc *RequestContext) ([]AuditEntry, error)
+}
+
+// MetaStore keeps small json documents describing a namespace, e.g. its category order
+type MetaStore interface {
+	// GetMeta returns nil if the document does not exist
+	GetMeta(rc *RequestContext, name string) ([]byte, error)
+	SetMeta(rc *RequestContext, name string, value []byte) error
+	// UpdateMeta atomically replaces a document with what fn returns, fn gets
+	// nil if it does not exist. An error returned from fn aborts the update
+	// and is returned as is. The event, if any, is kept like by ItemStore,
+	// its data is left as is.
+	UpdateMeta(rc *RequestContext, name string, fn func(value []byte) ([]byte, error), event *Message) error
+}
+
+// stamp fills in what a store knows about event once its change is made,
+// item is nil for changes of other things
+func (msg *Message) stamp(rc *RequestContext, seq int64, item *Item) {
+	msg.Namespace = rc.namespaceID()
+	msg.Seq = seq
+	if item != nil {
+		msg.Version = item.Version
+		msg.Data = *item
+	}
+}
+
+// ChangeLog keeps recent events of every namespace numbered by a sequence,
+// events are added by the changes they describe, so their order is the order
+// of the changes and an event is never lost while its change is kept
+type ChangeLog interface {
+	// Since returns json encoded events of the namespace with sequence greater than seq,
+	// ok is false when some of them are no longer kept and a full resync is needed
+	Since(namespace string, seq int64) (events []json.RawMessage, ok bool, err error)
+	// Seq returns the sequence of the last event of the namespace
+	Seq(namespace string) (int64, error)
+}
+
+// bump marks an item as changed, stores call it on every write
+func (item *Item) bump() {
+	item.Version++
+	now := time.Now().UTC()
+	item.UpdatedAt = &now
+}
+
+// trashed returns a copy of the item to keep in the trash
+func (item Item) trashed() Item {
+	deletedAt := time.Now().UTC()
+	item.DeletedAt = &deletedAt
+	return item
+}
+
+// UnmarshalJSON backfills fields missing in items stored before they were added,
+// they are written back with the next change of an item
+func (item *Item) UnmarshalJSON(data []byte) error {
+	type storedItem Item
+	if err := json.Unmarshal(data, (*storedItem)(item)); err != nil {
+		return err
+	}
+	if item.CreatedAt == nil {
+		item.CreatedAt = item.UpdatedAt
+	}
+	if item.IsChecked && item.CheckedAt == nil {
+		item.CheckedAt = item.UpdatedAt
+	}
+	return nil
+}
+
+// openStore picks a storage backend by its spec, which is one of
+// "redis" (uses -kvhost), "file:/path/to/data.db" or "memory"
+func openStore(spec string) (Store, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "redis":
+		s := newRedisStore(newRedisPool(*kvhost))
+		migrated, err := s.migrate()
+		if err != nil {
+			return nil, fmt.Errorf("unable to migrate items into namespace hashes: %w", err)
+		}
+		if migrated > 0 {
+			log.Info().Int("count", migrated).Msg("Migrated items into namespace hashes")
+		}
+		return s, nil
+	case "file":
+		if arg == "" {
+			return nil, errors.New("file store requires a path, e.g. file:/var/lib/groceries/data.db")
+		}
+		return openFileStore(arg)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown store %q", spec)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Name of the store profiles document, see MetaStore
+const storeProfilesMeta = "store_profiles"
+
+// StoreProfile describes the layout of a shop, items listed with ?store=
+// follow its aisles. Categories without an aisle go after the rest.
+type StoreProfile struct {
+	Name string `json:"name"`
+	// Aisles maps categories to aisle numbers, several categories can share an aisle
+	Aisles map[string]int `json:"aisles"`
+}
+
+// StoreProfileRequest is the body of PUT /api/v1/namespaces/{prefix}/{namespace}/stores/{name}
+type StoreProfileRequest struct {
+	Aisles map[string]int `json:"aisles"`
+}
+
+var errStoreNotFound = &APIError{Status: http.StatusNotFound, Code: "store_not_found", Message: "store profile not found"}
+
+// categories returns categories of the profile in aisle order
+func (p StoreProfile) categories() []string {
+	categories := make([]string, 0, len(p.Aisles))
+	for category := range p.Aisles {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		a, b := categories[i], categories[j]
+		if p.Aisles[a] != p.Aisles[b] {
+			return p.Aisles[a] < p.Aisles[b]
+		}
+		return a < b
+	})
+	return categories
+}
+
+func (h *Handlers) storeProfiles(rc *RequestContext) (map[string]StoreProfile, error) {
+	profiles := map[string]StoreProfile{}
+	value, err := h.store.GetMeta(rc, storeProfilesMeta)
+	if err != nil || value == nil {
+		return profiles, err
+	}
+	if err := json.Unmarshal(value, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// updateStoreProfiles applies fn to the stored profiles atomically,
+// concurrent changes of different profiles are all kept
+func (h *Handlers) updateStoreProfiles(rc *RequestContext, fn func(profiles map[string]StoreProfile) error) error {
+	return h.store.UpdateMeta(rc, storeProfilesMeta, func(value []byte) ([]byte, error) {
+		profiles := map[string]StoreProfile{}
+		if value != nil {
+			if err := json.Unmarshal(value, &profiles); err != nil {
+				return nil, err
+			}
+		}
+		if err := fn(profiles); err != nil {
+			return nil, err
+		}
+		return json.Marshal(profiles)
+	}, nil)
+}
+
+func (h *Handlers) storeProfile(rc *RequestContext, name string) (StoreProfile, error) {
+	profiles, err := h.storeProfiles(rc)
+	if err != nil {
+		return StoreProfile{}, err
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return profile, errStoreNotFound
+	}
+	return profile, nil
+}
+
+func (h *Handlers) StoresHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	profiles, err := h.storeProfiles(rc)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	list := make([]StoreProfile, 0, len(profiles))
+	for _, profile := range profiles {
+		list = append(list, profile)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *Handlers) apiGetStore(w http.ResponseWriter, r *http.Request, rc *RequestContext, name string) {
+	profile, err := h.storeProfile(rc, name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+func (h *Handlers) apiPutStore(w http.ResponseWriter, r *http.Request, rc *RequestContext, name string) {
+	var req StoreProfileRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeError(w, r, bodyError(err))
+		return
+	}
+	profile := StoreProfile{Name: name, Aisles: req.Aisles}
+	if profile.Aisles == nil {
+		profile.Aisles = map[string]int{}
+	}
+	err := h.updateStoreProfiles(rc, func(profiles map[string]StoreProfile) error {
+		profiles[name] = profile
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+func (h *Handlers) apiDeleteStore(w http.ResponseWriter, r *http.Request, rc *RequestContext, name string) {
+	err := h.updateStoreProfiles(rc, func(profiles map[string]StoreProfile) error {
+		if _, ok := profiles[name]; !ok {
+			return errStoreNotFound
+		}
+		delete(profiles, name)
+		return nil
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
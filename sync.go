@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Maximum size of a batch of offline mutations
+const maxSyncBodySize = 1 << 20
+
+// Change is the latest known state of an item, deleted items are tombstones
+type Change struct {
+	UID     string `json:"uid"`
+	Seq     int64  `json:"seq"`
+	Deleted bool   `json:"deleted"`
+	Item    *Item  `json:"item,omitempty"`
+}
+
+type ChangesResponse struct {
+	// Cursor is passed as since to get the next changes
+	Cursor int64 `json:"cursor"`
+	// Resync is set when the cursor is too old, changes then contain all items
+	Resync  bool     `json:"resync"`
+	Changes []Change `json:"changes"`
+}
+
+// SyncMutation is a change made by an offline client
+type SyncMutation struct {
+	// Op is one of add, edit, toggle and delete
+	Op       string `json:"op"`
+	UID      string `json:"uid"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// IsChecked is the state set by toggle, so replaying it is safe
+	IsChecked bool `json:"is_checked"`
+	// Version the client has based the change on
+	Version int64 `json:"version"`
+	// ClientTS is when the change was made on the client
+	ClientTS time.Time `json:"client_ts"`
+}
+
+type SyncRequest struct {
+	Mutations []SyncMutation `json:"mutations"`
+}
+
+// SyncResult status is applied, skipped (nothing to do), conflict or error.
+// Item is the stored state after the mutation, if there is one.
+type SyncResult struct {
+	Status string `json:"status"`
+	Item   *Item  `json:"item,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type SyncResponse struct {
+	Results []SyncResult `json:"results"`
+	Cursor  int64        `json:"cursor"`
+}
+
+func (h *Handlers) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		writeError(w, r, fieldError("since", "must be a non-negative integer"))
+		return
+	}
+	// a client without a cursor needs every item, including the ones
+	// written before the change log existed or before a restart
+	events, ok := []json.RawMessage(nil), false
+	if since > 0 {
+		events, ok, err = h.store.Since(rc.namespaceID(), since)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	var resp ChangesResponse
+	if ok {
+		resp = collapseChanges(since, events)
+	} else {
+		resp, err = h.snapshot(rc)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handlers) SyncHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	var req SyncRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSyncBodySize)).Decode(&req); err != nil {
+		writeError(w, r, bodyError(err))
+		return
+	}
+	clientID := r.Header.Get(wsClientIdHeader)
+	resp := SyncResponse{Results: make([]SyncResult, 0, len(req.Mutations))}
+	for _, m := range req.Mutations {
+		resp.Results = append(resp.Results, h.applyMutation(rc, clientID, m))
+	}
+	cursor, err := h.store.Seq(rc.namespaceID())
+	if err != nil {
+		log.Error().Err(err).Str("namespace", rc.namespaceID()).Msg("Unable to read change log")
+	}
+	resp.Cursor = cursor
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// collapseChanges keeps only the latest event of every item. Events are taken
+// in the order of their sequence numbers, a delete is final unless the item
+// is added or restored after it, otherwise the highest version wins.
+func collapseChanges(since int64, events []json.RawMessage) ChangesResponse {
+	type event struct {
+		Type    string `json:"type"`
+		Seq     int64  `json:"seq"`
+		Version int64  `json:"version"`
+		Data    Item   `json:"data"`
+	}
+	msgs := make([]event, 0, len(events))
+	for _, data := range events {
+		var msg event
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+
+	resp := ChangesResponse{Cursor: since, Changes: make([]Change, 0)}
+	positions := map[string]int{}
+	versions := map[string]int64{}
+	for _, msg := range msgs {
+		if msg.Seq > resp.Cursor {
+			resp.Cursor = msg.Seq
+		}
+		if msg.Data.UID == "" {
+			continue
+		}
+		change := Change{UID: msg.Data.UID, Seq: msg.Seq}
+		if msg.Type == "delete" {
+			change.Deleted = true
+		} else {
+			item := msg.Data
+			change.Item = &item
+		}
+		i, ok := positions[change.UID]
+		if !ok {
+			positions[change.UID] = len(resp.Changes)
+			versions[change.UID] = msg.Version
+			resp.Changes = append(resp.Changes, change)
+			continue
+		}
+		// a new item with the same uid starts over with its own versions
+		reborn := msg.Type == "add" || msg.Type == "restore"
+		if !reborn && (resp.Changes[i].Deleted || msg.Version < versions[change.UID]) {
+			continue
+		}
+		versions[change.UID] = msg.Version
+		resp.Changes[i] = change
+	}
+	return resp
+}
+
+// snapshot returns all items as changes for clients which are too far behind
+func (h *Handlers) snapshot(rc *RequestContext) (ChangesResponse, error) {
+	// the cursor is taken first, so changes made while listing are not lost
+	cursor, err := h.store.Seq(rc.namespaceID())
+	if err != nil {
+		return ChangesResponse{}, err
+	}
+	items, err := h.store.List(rc)
+	if err != nil {
+		return ChangesResponse{}, err
+	}
+	resp := ChangesResponse{Cursor: cursor, Resync: true, Changes: make([]Change, 0, len(items))}
+	for i := range items {
+		resp.Changes = append(resp.Changes, Change{UID: items[i].UID, Seq: cursor, Item: &items[i]})
+	}
+	return resp, nil
+}
+
+// check resolves conflicts of an offline change: it is applied when it is based
+// on the current version of the item or when it was made after the last change
+// of the item (last writer wins), a change without either is always applied
+func (m SyncMutation) check(item Item) error {
+	if m.Version == 0 && m.ClientTS.IsZero() {
+		return nil
+	}
+	if m.Version != 0 && m.Version == item.Version {
+		return nil
+	}
+	if !m.ClientTS.IsZero() && (item.UpdatedAt == nil || !item.UpdatedAt.After(m.ClientTS)) {
+		return nil
+	}
+	return ErrVersionMismatch
+}
+
+func (h *Handlers) applyMutation(rc *RequestContext, clientID string, m SyncMutation) SyncResult {
+	var item Item
+	var err error
+	switch m.Op {
+	case "add":
+		if _, err := uuid.Parse(m.UID); err != nil {
+			return SyncResult{Status: "error", Error: "uid has to be a uuid generated by the client"}
+		}
+		item, err = h.addItem(rc, clientID, Item{UID: m.UID, Name: m.Name, Category: m.Category})
+		if err == ErrItemExists {
+			// the mutation was already applied by an earlier sync
+			return h.currentItem(rc, m.UID, "skipped")
+		}
+	case "edit":
+		item, err = h.editItem(rc, clientID, m.UID, m.Name, m.Category, m.check)
+	case "toggle":
+		item, err = h.setItemChecked(rc, clientID, m.UID, m.IsChecked, m.check)
+	case "delete":
+		item, err = h.deleteItem(rc, clientID, m.UID, m.check)
+		if err == nil {
+			return SyncResult{Status: "applied"}
+		}
+		if err == ErrItemNotFound {
+			return SyncResult{Status: "skipped"}
+		}
+	default:
+		return SyncResult{Status: "error", Error: errUnknownOp.Error()}
+	}
+	switch {
+	case err == nil:
+		return SyncResult{Status: "applied", Item: &item}
+	case err == ErrVersionMismatch:
+		return h.currentItem(rc, m.UID, "conflict")
+	case err == ErrItemNotFound:
+		// the item was deleted while the client was offline
+		return SyncResult{Status: "conflict", Error: err.Error()}
+	case isValidationError(err):
+		return SyncResult{Status: "error", Error: err.Error()}
+	}
+	log.Error().Err(err).Str("op", m.Op).Str("uid", m.UID).Str("namespace", rc.namespaceID()).Msg("Unable to apply offline mutation")
+	if apiErr, ok := asAPIError(err); ok {
+		return SyncResult{Status: "error", Error: apiErr.Message}
+	}
+	return SyncResult{Status: "error", Error: errInternal.Message}
+}
+
+func (h *Handlers) currentItem(rc *RequestContext, uid, status string) SyncResult {
+	item, err := h.store.Get(rc, uid)
+	if err != nil {
+		return SyncResult{Status: status}
+	}
+	return SyncResult{Status: status, Item: &item}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCollapseChangesOutOfOrder(t *testing.T) {
+	event := func(msgType, uid string, seq, version int64) json.RawMessage {
+		data, _ := json.Marshal(Message{Type: msgType, Seq: seq, Version: version, Data: Item{UID: uid, Version: version}})
+		return data
+	}
+	events := []json.RawMessage{
+		// the newer edit comes first
+		event("edit", "a", 3, 3),
+		event("add", "a", 1, 1),
+		event("edit", "a", 2, 2),
+		// a stale edit after the delete does not bring the item back
+		event("edit", "b", 6, 2),
+		event("delete", "b", 5, 2),
+		event("add", "b", 4, 1),
+		// a restore after the delete does
+		event("restore", "c", 9, 3),
+		event("delete", "c", 8, 2),
+		event("add", "c", 7, 1),
+		// a lower version arriving with a higher sequence is dropped
+		event("edit", "d", 11, 5),
+		event("edit", "d", 12, 4),
+		// so is an event of another kind without an item
+		event("reorder", "", 13, 0),
+	}
+
+	resp := collapseChanges(0, events)
+	if resp.Cursor != 13 {
+		t.Errorf("cursor is %d, want 13", resp.Cursor)
+	}
+	want := map[string]struct {
+		deleted bool
+		version int64
+	}{
+		"a": {false, 3},
+		"b": {true, 0},
+		"c": {false, 3},
+		"d": {false, 5},
+	}
+	if len(resp.Changes) != len(want) {
+		t.Fatalf("got %d changes, want %d", len(resp.Changes), len(want))
+	}
+	for _, change := range resp.Changes {
+		w := want[change.UID]
+		if change.Deleted != w.deleted {
+			t.Errorf("%s deleted is %v, want %v", change.UID, change.Deleted, w.deleted)
+		}
+		if !w.deleted && (change.Item == nil || change.Item.Version != w.version) {
+			t.Errorf("%s is %+v, want version %d", change.UID, change.Item, w.version)
+		}
+	}
+}
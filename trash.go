@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How often the trash is purged of items older than the retention period
+const trashPurgeInterval = time.Hour
+
+func (h *Handlers) restoreItem(rc *RequestContext, clientID, uid string) (Item, error) {
+	if uid == "" {
+		return Item{}, errUIDRequired
+	}
+	unlock := h.lockNamespace(rc)
+	event := newEvent(clientID, "restore")
+	item, err := h.store.Restore(rc, uid, event)
+	if err == nil {
+		h.publish(event)
+	}
+	unlock()
+	if err != nil {
+		return item, err
+	}
+	h.audit(rc, "restore", nil, &item)
+	return item, nil
+}
+
+// trashItems returns deleted items of a namespace, the latest deleted first
+func (h *Handlers) trashItems(rc *RequestContext) ([]Item, error) {
+	items, err := h.store.Trash(rc)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.DeletedAt != nil && b.DeletedAt != nil && !a.DeletedAt.Equal(*b.DeletedAt) {
+			return a.DeletedAt.After(*b.DeletedAt)
+		}
+		return a.UID < b.UID
+	})
+	return items, nil
+}
+
+// purgeTrash removes items deleted longer than retention ago, it never returns
+func purgeTrash(store Store, retention time.Duration) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := store.Purge(time.Now().Add(-retention))
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to purge trash")
+		} else if purged > 0 {
+			log.Info().Int("purged", purged).Msg("Purged trash")
+		}
+		<-ticker.C
+	}
+}
+
+func (h *Handlers) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	items, err := h.trashItems(rc)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+func (h *Handlers) RestoreItemHandler(w http.ResponseWriter, r *http.Request) {
+	rc := r.Context().Value(groceriesRequestContextKey).(*RequestContext)
+	item, err := h.restoreItem(rc, r.Header.Get(wsClientIdHeader), r.URL.Query().Get("uid"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeItem(w, item)
+}
+
+func (h *Handlers) apiRestoreItem(w http.ResponseWriter, r *http.Request, rc *RequestContext, uid string) {
+	item, err := h.restoreItem(rc, r.Header.Get(wsClientIdHeader), uid)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeItem(w, item)
+}
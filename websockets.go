@@ -4,68 +4,265 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-    "github.com/rs/zerolog/log"
+	"github.com/rs/zerolog/log"
 )
 
 type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
+	changes       ChangeLog
+	clients       map[*Client]bool
+	broadcast     chan *Message
+	direct        chan directMessage
+	register      chan *Client
+	unregister    chan *Client
+	subscriptions chan subscription
+	// replays carry change log reads, which are made outside the hub loop
+	replays chan replay
+	// presence counts connections of every user per namespace
+	presence         map[string]map[string]int
+	presenceRequests chan presenceRequest
+	// remotePresence keeps states of other instances per namespace and origin,
+	// origins are the instances seen within presenceTTL, see presenceState
+	remotePresence map[string]map[string]remotePresence
+	origins        map[string]time.Time
+	remoteStates   chan presenceState
+	// sharedPresence is nil when there is only one instance, see RedisFanout
+	sharedPresence chan presenceState
 }
 
-func newHub() *Hub {
+// directMessage is sent to a single client only
+type directMessage struct {
+	client  *Client
+	message []byte
+}
+
+type subscription struct {
+	client    *Client
+	namespace string
+	active    bool
+	// since is the last event sequence seen by the client, missed events
+	// are replayed to it on subscribe, negative value means no replay
+	since int64
+}
+
+// replay is the result of reading events missed by a client
+type replay struct {
+	client    *Client
+	namespace string
+	since     int64
+	events    []json.RawMessage
+	ok        bool
+}
+
+// heldMessage is a live event waiting for the replay of its namespace
+type heldMessage struct {
+	seq     int64
+	message []byte
+}
+
+func newHub(changes ChangeLog) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		changes:       changes,
+		broadcast:     make(chan *Message),
+		direct:        make(chan directMessage),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		subscriptions: make(chan subscription),
+		replays:       make(chan replay),
+		clients:       make(map[*Client]bool),
+
+		presence:         make(map[string]map[string]int),
+		presenceRequests: make(chan presenceRequest),
+		remotePresence:   make(map[string]map[string]remotePresence),
+		origins:          make(map[string]time.Time),
+		remoteStates:     make(chan presenceState),
 	}
 }
 
 func (h *Hub) run() {
+	var refresh <-chan time.Time
+	if h.sharedPresence != nil {
+		ticker := time.NewTicker(presenceInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+			h.remove(client)
+		case s := <-h.subscriptions:
+			if _, ok := h.clients[s.client]; !ok {
+				continue
+			}
+			if !s.active {
+				h.leave(s.client, s.namespace)
+				continue
+			}
+			h.join(s.client, s.namespace)
+			if s.since >= 0 {
+				h.startReplay(s.client, s.namespace, s.since)
 			}
-		case message := <-h.broadcast:
-			var msg Message
-			_ = json.Unmarshal(message, &msg)
-			for client := range h.clients {
-				if client.id == msg.ClientID {
-					continue
-				}
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+		case r := <-h.replays:
+			h.finishReplay(r)
+		case d := <-h.direct:
+			if _, ok := h.clients[d.client]; !ok {
+				continue
+			}
+			h.send(d.client, d.message)
+		case msg := <-h.broadcast:
+			h.deliver(msg)
+		case req := <-h.presenceRequests:
+			req.viewers <- h.viewers(req.namespace)
+		case state := <-h.remoteStates:
+			h.updateRemotePresence(state)
+		case <-refresh:
+			h.refreshPresence()
+		}
+	}
+}
+
+// deliver sends msg to every client subscribed to its namespace
+func (h *Hub) deliver(msg *Message) {
+	message, err := json.Marshal(msg)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to marshal message")
+		return
+	}
+	for client := range h.clients {
+		if msg.ClientID != "" && client.id == msg.ClientID {
+			continue
+		}
+		// only clients subscribed to the namespace can see its events
+		if !client.namespaces[msg.Namespace] {
+			continue
+		}
+		if held, ok := client.held[msg.Namespace]; ok {
+			if len(held) >= cap(client.send) {
+				h.remove(client)
+				continue
 			}
+			client.held[msg.Namespace] = append(held, heldMessage{seq: msg.Seq, message: message})
+			continue
 		}
+		h.send(client, message)
+	}
+}
+
+// send drops the client if it can not keep up
+func (h *Hub) send(client *Client, message []byte) {
+	// dropped while a batch was being sent to it
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	select {
+	case client.send <- message:
+	default:
+		h.remove(client)
+	}
+}
+
+func (h *Hub) remove(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+	close(client.send)
+	for namespace := range client.namespaces {
+		h.leave(client, namespace)
+	}
+}
+
+// startReplay reads events of the namespace missed by the client in the
+// background, the store may be slow or unreachable and the hub must not wait
+// for it. Live events of the namespace are held back until the replay is sent.
+func (h *Hub) startReplay(client *Client, namespace string, since int64) {
+	if _, ok := client.held[namespace]; ok {
+		return
+	}
+	if client.held == nil {
+		client.held = map[string][]heldMessage{}
+	}
+	client.held[namespace] = []heldMessage{}
+	// like /items/changes, a client which has seen nothing reloads everything
+	if since == 0 {
+		go func() {
+			h.replays <- replay{client: client, namespace: namespace}
+		}()
+		return
+	}
+	go func() {
+		events, ok, err := h.changes.Since(namespace, since)
+		if err != nil {
+			log.Error().Err(err).Str("namespace", namespace).Msg("Unable to read change log")
+		}
+		h.replays <- replay{client: client, namespace: namespace, since: since, events: events, ok: ok}
+	}()
+}
+
+// finishReplay sends events missed by the client, or asks it to reload
+// everything when they are not available, followed by live events held
+// back in the meantime which are not part of the replay
+func (h *Hub) finishReplay(r replay) {
+	client := r.client
+	held, ok := client.held[r.namespace]
+	if _, registered := h.clients[client]; !registered || !ok {
+		return
+	}
+	delete(client.held, r.namespace)
+	events := r.events
+	if !r.ok || len(events)+len(held) > cap(client.send)-len(client.send) {
+		message, _ := json.Marshal(Message{Type: "resync", Namespace: r.namespace})
+		events = []json.RawMessage{message}
+	}
+	last := r.since
+	if r.ok {
+		last += int64(len(r.events))
+	}
+	for _, event := range events {
+		h.send(client, event)
+	}
+	for _, m := range held {
+		// presence events have no sequence
+		if m.seq != 0 && m.seq <= last {
+			continue
+		}
+		h.send(client, m.message)
 	}
 }
 
 type Message struct {
 	ClientID string `json:"client_id"`
 	Type     string `json:"type"`
+	// Namespace the event belongs to, see RequestContext.namespaceID
+	Namespace string `json:"namespace"`
+	// Seq is the position of the event in the namespace change log,
+	// clients pass the last one they have seen to get missed events on reconnect
+	Seq int64 `json:"seq"`
+	// Version of the item after the change, allows clients to drop stale events
+	Version int64 `json:"version"`
 	// Data has to be a marshalable json struct
 	Data interface{} `json:"data"`
 }
 
 type Client struct {
-	id   string
-	hub  *Hub
-	conn *websocket.Conn
-	send chan []byte
+	id       string
+	hub      *Hub
+	handlers *Handlers
+	conn     *websocket.Conn
+	send     chan []byte
+	user     *User
+	// namespaces the client is subscribed to, see RequestContext.namespaceID,
+	// it is only accessed by the hub once the client is registered
+	namespaces map[string]bool
+	// held are live events of namespaces being replayed, see Hub.startReplay,
+	// it is only accessed by the hub
+	held map[string][]heldMessage
 }
 
 func (c *Client) readPump() {
@@ -84,8 +281,8 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.hub.broadcast <- message
+		// frames are never fanned out as is, only the hub and handlers broadcast
+		c.handleCommand(bytes.TrimSpace(message))
 	}
 }
 
@@ -128,15 +325,46 @@ func (c *Client) writePump() {
 	}
 }
 
-func serveWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func serveWS(h *Handlers, w http.ResponseWriter, r *http.Request) {
+	rc, protocol := getStreamRequestContext(r)
+	if ok := rc.isAuthorized(); !ok {
+		writeError(w, r, errUnauthorized)
+		return
+	}
+	var responseHeader http.Header
+	if protocol != "" {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {protocol}}
+	}
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		log.Info().Err(err)
+		log.Info().Err(err).Msg("Unable to upgrade websocket connection")
 		return
 	}
 	clientID := r.URL.Query().Get("client_id")
-	client := &Client{id: clientID, hub: hub, conn: conn, send: make(chan []byte, 256)}
+	if clientID == "" {
+		// the id is needed to skip echoes of changes made over the socket
+		clientID = uuid.NewString()
+	}
+	client := &Client{
+		id:         clientID,
+		hub:        h.hub,
+		handlers:   h,
+		conn:       conn,
+		send:       make(chan []byte, 256),
+		user:       rc.User,
+		namespaces: map[string]bool{},
+	}
 	client.hub.register <- client
+	// the initial subscription can be passed in the query,
+	// otherwise the client is expected to send a subscribe command
+	data := namespaceData{NamespacePrefix: rc.NamespacePrefix, Namespace: rc.Namespace}
+	if rc, err := data.requestContext(rc.User); err == nil {
+		since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			since = -1
+		}
+		client.hub.subscriptions <- subscription{client: client, namespace: rc.namespaceID(), active: true, since: since}
+	}
 
 	go client.writePump()
 	go client.readPump()
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Command is a frame sent by a websocket client, e.g.
+// {"id": "1", "op": "subscribe", "data": {"namespace_prefix": "g", "namespace": "default"}}
+// {"id": "2", "op": "add", "data": {"namespace_prefix": "g", "namespace": "default", "name": "milk"}}
+type Command struct {
+	// ID is optional and is copied into the reply
+	ID   string          `json:"id,omitempty"`
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Reply is sent only to the client which issued a command.
+// Type is "ack" with the stored item as Data for mutations, "pong" or "error".
+type Reply struct {
+	ID    string      `json:"id,omitempty"`
+	Type  string      `json:"type"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+	// Code is the APIError code of the error
+	Code string `json:"code,omitempty"`
+}
+
+type namespaceData struct {
+	NamespacePrefix string `json:"namespace_prefix"`
+	Namespace       string `json:"namespace"`
+}
+
+type subscribeData struct {
+	namespaceData
+	// Since is the last seen event sequence, missed events are replayed
+	Since *int64 `json:"since"`
+}
+
+type itemData struct {
+	namespaceData
+	UID      string `json:"uid"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// Note is left as is by edit when it is not given
+	Note *string `json:"note"`
+	// Version works like If-Match header, zero means any version
+	Version int64 `json:"version"`
+}
+
+var (
+	errUnknownOp        = &APIError{Status: http.StatusBadRequest, Code: "unknown_op", Message: "unknown op"}
+	errMalformedCommand = &APIError{Status: http.StatusBadRequest, Code: "malformed_command", Message: "malformed command"}
+	errInvalidNamespace = &APIError{Status: http.StatusBadRequest, Code: "invalid_namespace", Message: "invalid namespace"}
+)
+
+// requestContext validates namespace of a command against the client user
+func (d namespaceData) requestContext(user *User) (*RequestContext, error) {
+	if d.Namespace == "" || (d.NamespacePrefix != "g" && d.NamespacePrefix != "my") {
+		return nil, errInvalidNamespace
+	}
+	return &RequestContext{User: user, NamespacePrefix: d.NamespacePrefix, Namespace: d.Namespace}, nil
+}
+
+func (c *Client) handleCommand(message []byte) {
+	var cmd Command
+	if err := json.Unmarshal(message, &cmd); err != nil || cmd.Op == "" {
+		c.reply(errorReply("", errMalformedCommand))
+		return
+	}
+	data, err := c.execute(cmd)
+	if err != nil {
+		apiErr, ok := asAPIError(err)
+		if !ok {
+			apiErr = errInternal
+		}
+		if apiErr.Status >= http.StatusInternalServerError {
+			log.Error().Err(err).Str("op", cmd.Op).Str("client", c.id).Msg("Unable to execute websocket command")
+		}
+		c.reply(errorReply(cmd.ID, apiErr))
+		return
+	}
+	replyType := "ack"
+	if cmd.Op == "ping" {
+		replyType = "pong"
+	}
+	c.reply(Reply{ID: cmd.ID, Type: replyType, Data: data})
+}
+
+func (c *Client) execute(cmd Command) (interface{}, error) {
+	switch cmd.Op {
+	case "ping":
+		return nil, nil
+	case "subscribe", "unsubscribe":
+		var data subscribeData
+		if err := json.Unmarshal(cmd.Data, &data); err != nil {
+			return nil, errMalformedCommand
+		}
+		// personal namespaces are keyed by the username,
+		// so a user can never subscribe to someone else's
+		rc, err := data.requestContext(c.user)
+		if err != nil {
+			return nil, err
+		}
+		since := int64(-1)
+		if data.Since != nil {
+			since = *data.Since
+		}
+		c.hub.subscriptions <- subscription{client: c, namespace: rc.namespaceID(), active: cmd.Op == "subscribe", since: since}
+		return nil, nil
+	case "add", "edit", "toggle", "delete":
+		var data itemData
+		if err := json.Unmarshal(cmd.Data, &data); err != nil {
+			return nil, errMalformedCommand
+		}
+		rc, err := data.requestContext(c.user)
+		if err != nil {
+			return nil, err
+		}
+		h, check := c.handlers, versionCheck(data.Version)
+		switch cmd.Op {
+		case "add":
+			item := Item{Name: data.Name, Category: data.Category}
+			if data.Note != nil {
+				item.Note = *data.Note
+			}
+			return h.addItem(rc, c.id, item)
+		case "edit":
+			return h.patchItem(rc, c.id, data.UID, ItemPatch{Name: &data.Name, Category: &data.Category, Note: data.Note}, check)
+		case "toggle":
+			return h.toggleItem(rc, c.id, data.UID, check)
+		case "delete":
+			return h.deleteItem(rc, c.id, data.UID, check)
+		}
+	}
+	return nil, errUnknownOp
+}
+
+func errorReply(id string, err *APIError) Reply {
+	return Reply{ID: id, Type: "error", Error: err.Message, Code: err.Code}
+}
+
+func (c *Client) reply(reply Reply) {
+	message, err := json.Marshal(reply)
+	if err != nil {
+		return
+	}
+	c.hub.direct <- directMessage{client: c, message: message}
+}